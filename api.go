@@ -0,0 +1,279 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	triggerSchedule = "schedule"
+	triggerAPI      = "api"
+	triggerWebhook  = "webhook"
+	triggerCLI      = "cli"
+)
+
+// buildTriggers queues builds requested via the API for the main loop which also runs the scheduled ones.
+var buildTriggers = make(chan buildTrigger, 1)
+
+// buildTrigger requests a build of a profile or, if empty, of all of them.
+type buildTrigger struct {
+	profile string
+	by      string
+}
+
+var status = &daemonStatus{profiles: map[string]*profileStatus{}}
+
+// daemonStatus is what the API reports.
+type daemonStatus struct {
+	sync.RWMutex
+
+	profiles map[string]*profileStatus
+}
+
+type profileStatus struct {
+	NextBuild time.Time         `json:"next_build"`
+	LastBuild *buildStatus      `json:"last_build"`
+	Selected  *selectedVersions `json:"selected"`
+}
+
+type buildStatus struct {
+	Trigger  string       `json:"trigger"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	OK       bool         `json:"ok"`
+	Problems []modProblem `json:"problems"`
+	Unknown  int          `json:"unknown_repos"`
+}
+
+// selectedVersions are the versions the last successful build of a profile chose.
+type selectedVersions struct {
+	Framework selectedVersion            `json:"framework"`
+	Modules   map[string]selectedVersion `json:"modules"`
+}
+
+type selectedVersion struct {
+	Ref    string `json:"ref"`
+	Commit string `json:"commit"`
+}
+
+func newSelectedVersions(res *buildResult) *selectedVersions {
+	sv := &selectedVersions{
+		selectedVersion{res.framework.ref, res.framework.commit}, make(map[string]selectedVersion, len(res.mods)),
+	}
+
+	for name, repo := range res.mods {
+		sv.Modules[name] = selectedVersion{repo.ref, repo.commit}
+	}
+
+	return sv
+}
+
+// reset forgets all profiles except the given ones.
+func (ds *daemonStatus) reset(profiles []*profile) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	old := ds.profiles
+	ds.profiles = make(map[string]*profileStatus, len(profiles))
+
+	for _, p := range profiles {
+		if ps, ok := old[p.name]; ok {
+			ds.profiles[p.name] = ps
+		} else {
+			ds.profiles[p.name] = &profileStatus{}
+		}
+	}
+}
+
+func (ds *daemonStatus) scheduled(profile string, next time.Time) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	if ps, ok := ds.profiles[profile]; ok {
+		ps.NextBuild = next
+	}
+}
+
+func (ds *daemonStatus) built(profile string, build *buildStatus, selected *selectedVersions) {
+	ds.Lock()
+	defer ds.Unlock()
+
+	if ps, ok := ds.profiles[profile]; ok {
+		ps.LastBuild = build
+
+		if selected != nil {
+			ps.Selected = selected
+		}
+	}
+}
+
+func (ds *daemonStatus) has(profile string) bool {
+	ds.RLock()
+	defer ds.RUnlock()
+
+	if profile == "" {
+		return len(ds.profiles) > 0
+	}
+
+	_, ok := ds.profiles[profile]
+	return ok
+}
+
+func (ds *daemonStatus) marshal() ([]byte, error) {
+	ds.RLock()
+	defer ds.RUnlock()
+
+	return json.Marshal(struct {
+		Profiles map[string]*profileStatus `json:"profiles"`
+	}{ds.profiles})
+}
+
+var apiAuth = &apiToken{}
+
+// apiToken is the bearer token required for triggering builds via the API.
+type apiToken struct {
+	sync.RWMutex
+
+	token []byte
+}
+
+// configure applies the token of a successfully validated config.yml.
+func (at *apiToken) configure(token, tokenFile string) {
+	var raw []byte
+	if token != "" || tokenFile != "" {
+		if tk, ok := readToken(token, tokenFile); ok && tk != "" {
+			raw = []byte(tk)
+		}
+	}
+
+	at.Lock()
+	defer at.Unlock()
+
+	at.token = raw
+}
+
+// authorized tells whether r carries the configured token. Without one nobody is authorized.
+func (at *apiToken) authorized(r *http.Request) bool {
+	at.RLock()
+	token := at.token
+	at.RUnlock()
+
+	if token == nil {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(token, []byte(strings.TrimPrefix(auth, "Bearer "))) == 1
+}
+
+// apiServer is the optional HTTP control and status API.
+type apiServer struct {
+	listen string
+	server *http.Server
+}
+
+// serveAPI (re)starts the API unless old already listens on listen.
+func serveAPI(old *apiServer, listen string) *apiServer {
+	if old != nil {
+		if old.listen == listen {
+			return old
+		}
+
+		log.WithFields(log.Fields{"listen": old.listen}).Info("Stopping HTTP API")
+
+		if errCl := old.server.Close(); errCl != nil {
+			log.WithFields(log.Fields{"listen": old.listen, "error": jsonableError{errCl}}).Warn(
+				"Couldn't stop HTTP API",
+			)
+		}
+	}
+
+	if listen == "" {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"listen": listen}).Info("Starting HTTP API")
+
+	listener, errLs := net.Listen("tcp", listen)
+	if errLs != nil {
+		log.WithFields(log.Fields{"listen": listen, "error": jsonableError{errLs}}).Error("Couldn't listen")
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", handleStatus)
+	mux.HandleFunc("/build", handleBuild)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/webhook", handleWebhook)
+
+	api := &apiServer{listen, &http.Server{Handler: mux}}
+	go api.serve(listener)
+
+	return api
+}
+
+func (as *apiServer) serve(listener net.Listener) {
+	if errSv := as.server.Serve(listener); errSv != http.ErrServerClosed {
+		log.WithFields(log.Fields{"listen": as.listen, "error": jsonableError{errSv}}).Error("HTTP API failed")
+	}
+}
+
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, errMs := status.marshal()
+	if errMs != nil {
+		log.WithFields(log.Fields{"error": jsonableError{errMs}}).Error("Couldn't marshal status")
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
+
+func handleBuild(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !apiAuth.authorized(r) {
+		log.WithFields(log.Fields{"remote": r.RemoteAddr}).Warn("Unauthorized build request via API")
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	profile := r.URL.Query().Get("profile")
+	if !status.has(profile) {
+		if profile == "" {
+			http.Error(w, "No valid config loaded", http.StatusServiceUnavailable)
+		} else {
+			http.Error(w, "No such profile", http.StatusNotFound)
+		}
+
+		return
+	}
+
+	select {
+	case buildTriggers <- buildTrigger{profile, triggerAPI}:
+		log.WithFields(log.Fields{"profile": profile, "remote": r.RemoteAddr}).Info("Build requested via API")
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		http.Error(w, "Build already queued", http.StatusConflict)
+	}
+}
@@ -2,106 +2,222 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"github.com/google/go-github/v28/github"
 	"github.com/hashicorp/go-version"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"path"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
-func build(config *githubConfig, patterns map[string]*regexp.Regexp) (script []byte, unknown map[unknownRepo]struct{}) {
-	mods, unknown := fetchMods(config.Mods, patterns)
-	if mods == nil {
-		return nil, nil
+// buildResult is what a build chose and discovered.
+type buildResult struct {
+	framework gitRepo
+	mods      map[string]gitRepo
+	unknown   map[unknownRepo]struct{}
+	problems  []modProblem
+}
+
+// mirrorUsage tracks the mirrors each profile needs, so that one profile's build doesn't remove another's.
+type mirrorUsage struct {
+	profiles  int
+	byProfile map[string]map[string]gitSource
+}
+
+func newMirrorUsage(profiles int) *mirrorUsage {
+	return &mirrorUsage{profiles, map[string]map[string]gitSource{}}
+}
+
+// use records the mirrors profile needs and returns the ones all profiles need.
+// Until every profile has told its needs, it returns nil. So does a nil mu which never prunes any mirrors.
+func (mu *mirrorUsage) use(profile string, mirrors map[string]gitSource) map[string]gitSource {
+	if mu == nil {
+		return nil
 	}
 
-	reposByDir := make(map[string]string, 1+len(mods))
-	reposByDir[hex.EncodeToString([]byte(config.Framework))] = config.Framework
+	mu.byProfile[profile] = mirrors
+	if len(mu.byProfile) < mu.profiles {
+		return nil
+	}
 
-	for _, repo := range mods {
-		reposByDir[hex.EncodeToString([]byte(repo))] = repo
+	all := map[string]gitSource{}
+	for _, needs := range mu.byProfile {
+		for dir, src := range needs {
+			all[dir] = src
+		}
 	}
 
+	return all
+}
+
+func build(
+	profile string, config *githubConfig, patterns map[string]*regexp.Regexp, tarballs bool, mirrors *mirrorUsage,
+) *buildResult {
+	failures.enter(phaseFetchMods)
+	start := time.Now()
+	mods, unknown, _, _ := fetchMods(config, patterns)
+	metrics.phase(profile, phaseFetchMods, start)
+
+	if mods == nil {
+		return nil
+	}
+
+	frameworkOrigin := newRepoOrigin(newFrameworkForge(config), config.Framework)
+	framework := gitSource{
+		frameworkOrigin, frameworkOrigin.forge.cloneURL(frameworkOrigin.owner, frameworkOrigin.name),
+		config.FrameworkVersion, config.FrameworkTrack, "",
+	}
+	reposByDir := make(map[string]gitSource, 1+len(mods))
+
 	for repo := range unknown {
-		repo := fmt.Sprintf("%s/%s", repo.Owner, repo.Name)
-		reposByDir[hex.EncodeToString([]byte(repo))] = repo
+		reposByDir[mirrorDir(repo.remote)] = gitSource{
+			repoOrigin: repoOrigin{repo.forge, repo.Owner, repo.Name}, remote: repo.remote,
+		}
 	}
 
+	for _, src := range mods {
+		reposByDir[mirrorDir(src.remote)] = src
+	}
+
+	reposByDir[mirrorDir(framework.remote)] = framework
+
 	chUpd := make(chan map[string]gitRepo, 1)
 	chRm := make(chan struct{})
 
+	failures.enter(phaseUpdateMirrors)
+	adoptLegacyMirrors(reposByDir)
+
+	start = time.Now()
 	go updateMirrors(reposByDir, chUpd)
-	go rmObsolete(reposByDir, chRm)
+
+	if needed := mirrors.use(profile, reposByDir); needed == nil {
+		log.WithFields(log.Fields{"profile": profile}).Debug("Not all profiles built yet, keeping all mirrors")
+		close(chRm)
+	} else {
+		go rmObsolete(needed, chRm)
+	}
 
 	defer waitFor(chRm)
 
 	updated := <-chUpd
+	metrics.phase(profile, phaseUpdateMirrors, start)
+
 	if updated == nil {
-		return nil, nil
+		return nil
 	}
 
-	var buf bytes.Buffer
+	frameworkRepo := updated[framework.remote]
+	var selected map[string]gitRepo
+	var problems []modProblem
 
 	{
-		framework := updated[config.Framework]
-		fmt.Fprintf(
-			&buf,
-			`#!/bin/sh
-set -exo pipefail
+		matched := make(map[string]gitRepo, len(mods))
+		for name, src := range mods {
+			repo := updated[src.remote]
+			repo.pattern = src.pattern
+			matched[name] = repo
+		}
 
-rm -rf dockerweb2-temp
-git clone --bare '%s' dockerweb2-temp
-# %s
-git -C dockerweb2-temp archive --prefix=icingaweb2/ %s |tar -x
-`,
-			framework.remote, framework.latestTag, framework.commit,
-		)
-	}
+		cc := newCompatChecker(&frameworkRepo)
 
-	{
-		sortedMods := make([]string, 0, len(mods))
-		for mod := range mods {
-			sortedMods = append(sortedMods, mod)
+		for {
+			var skipped map[string]string
+			selected, skipped = cc.selectCompatible(matched)
+
+			added, missing := cc.resolveDeps(matched, selected, unknown, updated)
+			if added {
+				continue
+			}
+
+			for _, name := range sortedModNames(matched) {
+				if reason, ok := skipped[name]; ok {
+					problems = append(problems, modProblem{name, reason})
+				}
+			}
+
+			problems = append(append(problems, missing...), cc.findCycles(selected)...)
+			break
 		}
+	}
 
-		sort.Strings(sortedMods)
-
-		for _, mod := range sortedMods {
-			repo := updated[mods[mod]]
-			fmt.Fprintf(
-				&buf,
-				`
-if [ ! -e 'icingaweb2/modules/%s' ]; then
-	rm -rf dockerweb2-temp
-	git clone --bare '%s' dockerweb2-temp
-	# %s
-	git -C dockerweb2-temp archive '--prefix=icingaweb2/modules/%s/' %s |tar -x
-fi
-`,
-				mod, repo.remote, repo.latestTag, mod, repo.commit,
-			)
+	if tarballs {
+		if !digestArchives(&frameworkRepo, selected) {
+			return nil
 		}
 	}
 
-	fmt.Fprint(&buf, `
-rm -rf dockerweb2-temp
-`)
+	return &buildResult{frameworkRepo, selected, unknown, problems}
+}
+
+// repoOrigin tells where a repository is hosted.
+type repoOrigin struct {
+	forge       forge
+	owner, name string
+}
+
+// newRepoOrigin splits ownerAndName like Icinga/icingaweb2.
+func newRepoOrigin(f forge, ownerAndName string) repoOrigin {
+	owner, name := path.Split(ownerAndName)
+	return repoOrigin{f, strings.TrimSuffix(owner, "/"), name}
+}
+
+// gitSource is a Git repository to fetch and how to choose the commit to use.
+type gitSource struct {
+	repoOrigin
+	remote, constraint, track string
+
+	// pattern is the repository pattern which matched, if any.
+	pattern string
+}
 
-	return buf.Bytes(), unknown
+type gitRef struct {
+	ref, commit string
 }
 
 type gitRepo struct {
-	remote, latestTag, commit string
+	gitSource
+	gitRef
+
+	// older are tags to fall back to, newest first.
+	older []string
+
+	// requiredBy is the module which made this one being added automatically, if any.
+	requiredBy string
+
+	// archiveURL and archiveDir locate the forge's tarball of commit, if any.
+	// archiveSHA256 is the digest of it (uncompressed).
+	archiveURL, archiveDir, archiveSHA256 string
+}
+
+type taggedVersion struct {
+	tag     string
+	version *version.Version
+}
+
+func (gr *gitRepo) describe() string {
+	switch track, _ := splitTrack(gr.track); track {
+	case trackBranch, trackCommit:
+		return gr.track
+	}
+
+	if gr.constraint == "" {
+		return gr.ref
+	}
+
+	return fmt.Sprintf("%s (%s)", gr.ref, gr.constraint)
 }
 
-func fetchGit(remote, local string, res chan<- gitRepo) {
+func fetchGit(src gitSource, local string, res chan<- gitRepo) {
+	remote := src.remote
 	log.WithFields(log.Fields{"remote": remote, "local": local}).Info("Fetching Git repo")
 
 	if _, errSt := os.Stat(local); errSt != nil {
@@ -142,62 +258,92 @@ func fetchGit(remote, local string, res chan<- gitRepo) {
 		return
 	}
 
-	tags, ok := runCmd("git", "-C", local, "tag")
-	if !ok {
-		res <- gitRepo{}
-		return
-	}
+	track, trackArg := splitTrack(src.track)
+	ref := "HEAD"
+	var older []string
+
+	switch track {
+	case trackBranch:
+		ref = "refs/heads/" + trackArg
+	case trackCommit:
+		ref = trackArg
+	default:
+		tags, ok := runCmd("git", "-C", local, "tag")
+		if !ok {
+			res <- gitRepo{}
+			return
+		}
 
-	latestTag := "HEAD"
+		var constraints version.Constraints
+		if src.constraint != "" {
+			var errNC error
+			if constraints, errNC = version.NewConstraint(src.constraint); errNC != nil {
+				log.WithFields(log.Fields{
+					"bad_constraint": src.constraint, "error": jsonableError{errNC},
+				}).Error("Bad version constraint")
 
-	{
-		latestFinalTag := ""
-		latestPreTag := ""
-
-		{
-			latestFinal := (*version.Version)(nil)
-			latestPre := (*version.Version)(nil)
-
-			for _, line := range bytes.Split(tags, []byte{'\n'}) {
-				if match := versionTag.FindSubmatch(line); match != nil {
-					ver, errNV := version.NewVersion(string(match[1]))
-					if errNV != nil {
-						log.WithFields(log.Fields{
-							"bad_version": string(match[1]), "error": jsonableError{errNV},
-						}).Warn("Something is wrong with a version")
-						continue
-					}
+				res <- gitRepo{}
+				return
+			}
+		}
 
-					if ver.Prerelease() == "" {
-						if latestFinal == nil || ver.GreaterThan(latestFinal) {
-							latestFinal = ver
-							latestFinalTag = string(line)
-						}
-					} else {
-						if latestPre == nil || ver.GreaterThan(latestPre) {
-							latestPre = ver
-							latestPreTag = string(line)
-						}
-					}
+		var finals, pres []taggedVersion
+
+		for _, line := range bytes.Split(tags, []byte{'\n'}) {
+			if match := versionTag.FindSubmatch(line); match != nil {
+				ver, errNV := version.NewVersion(string(match[1]))
+				if errNV != nil {
+					log.WithFields(log.Fields{
+						"bad_version": string(match[1]), "error": jsonableError{errNV},
+					}).Warn("Something is wrong with a version")
+					continue
+				}
+
+				if constraints != nil && !constraints.Check(ver) {
+					continue
+				}
+
+				if ver.Prerelease() == "" {
+					finals = append(finals, taggedVersion{string(line), ver})
+				} else {
+					pres = append(pres, taggedVersion{string(line), ver})
 				}
 			}
 		}
 
-		if latestFinalTag == "" {
-			if latestPreTag != "" {
-				latestTag = latestPreTag
+		candidates := finals
+		if len(finals) == 0 || track == trackLatestPrerelease {
+			candidates = append(finals, pres...)
+		}
+
+		sort.Slice(candidates, func(i, j int) bool {
+			return candidates[i].version.GreaterThan(candidates[j].version)
+		})
+
+		if len(candidates) > 0 {
+			ref = candidates[0].tag
+
+			for _, candidate := range candidates[1:] {
+				older = append(older, candidate.tag)
 			}
-		} else {
-			latestTag = latestFinalTag
+		}
+
+		if constraints != nil && ref == "HEAD" {
+			log.WithFields(log.Fields{
+				"remote": remote, "constraint": src.constraint,
+			}).Error("No tag satisfies the version constraint")
+
+			res <- gitRepo{}
+			return
 		}
 	}
 
-	log.WithFields(log.Fields{"remote": remote, "tag": latestTag}).Trace("Got latest tag")
+	log.WithFields(log.Fields{"remote": remote, "ref": ref}).Trace("Got ref to track")
 
-	latestTagCommit, ok := runCmd("git", "-C", local, "log", "-1", "--format=%H", latestTag)
+	commit, ok := runCmd("git", "-C", local, "rev-parse", "--verify", "--end-of-options", ref+"^{commit}")
 	if !ok {
-		if latestTag == "HEAD" {
-			res <- gitRepo{remote, latestTag, latestTag}
+		if ref == "HEAD" {
+			res <- gitRepo{gitSource: src, gitRef: gitRef{ref, ref}}
 		} else {
 			res <- gitRepo{}
 		}
@@ -205,23 +351,124 @@ func fetchGit(remote, local string, res chan<- gitRepo) {
 		return
 	}
 
-	latestTagCommit = bytes.TrimSpace(latestTagCommit)
-	log.WithFields(log.Fields{"remote": remote, "commit": string(latestTagCommit)}).Trace("Got latest tag's commit")
+	commit = bytes.TrimSpace(commit)
+	log.WithFields(log.Fields{"remote": remote, "commit": string(commit)}).Trace("Got ref's commit")
 
-	res <- gitRepo{remote, latestTag, string(latestTagCommit)}
+	res <- gitRepo{gitSource: src, gitRef: gitRef{ref, string(commit)}, older: older}
 }
 
-func fetchMods(mods []modConfig, patterns map[string]*regexp.Regexp) (
-	hits map[string]string, unknown map[unknownRepo]struct{},
+// digestArchives locates the forges' tarballs of the selected commits and computes their digests
+// from the local mirrors the way the forges create those tarballs.
+func digestArchives(framework *gitRepo, mods map[string]gitRepo) bool {
+	ch := make(chan bool, 1+len(mods))
+	repos := make([]*gitRepo, 0, 1+len(mods))
+	repos = append(repos, framework)
+
+	for _, name := range sortedModNames(mods) {
+		repo := mods[name]
+		repos = append(repos, &repo)
+	}
+
+	for _, repo := range repos {
+		go digestArchive(repo, ch)
+	}
+
+	ok := true
+	for range repos {
+		if !<-ch {
+			ok = false
+		}
+	}
+
+	for i, name := range sortedModNames(mods) {
+		mods[name] = *repos[i+1]
+	}
+
+	return ok
+}
+
+// digestArchive computes the SHA-256 digest of the uncompressed tarball of repo like digestArchives.
+// git archive's output isn't guaranteed to be stable across Git versions,
+// so the digest only matches the forge's tarball while the forge's Git creates it the same way as the local one.
+func digestArchive(repo *gitRepo, res chan<- bool) {
+	if repo.commit == "HEAD" {
+		res <- true
+		return
+	}
+
+	url, dir := repo.forge.archive(repo.owner, repo.name, repo.commit)
+	if url == "" {
+		log.WithFields(log.Fields{"remote": repo.remote}).Debug("Forge doesn't provide tarballs, falling back to Git")
+		res <- true
+		return
+	}
+
+	log.WithFields(log.Fields{"remote": repo.remote, "commit": repo.commit}).Debug("Computing tarball digest")
+
+	digest := sha256.New()
+	if !runCmdTo(
+		digest, "git", "-C", path.Join(gitMirrorPath, mirrorDir(repo.remote)),
+		"archive", "--format=tar", "--prefix="+dir+"/", repo.commit,
+	) {
+		res <- false
+		return
+	}
+
+	repo.archiveURL = url
+	repo.archiveDir = dir
+	repo.archiveSHA256 = hex.EncodeToString(digest.Sum(nil))
+	res <- true
+}
+
+// modMatch is a repository matched by a pattern of a mods entry.
+type modMatch struct {
+	// entry is the index of the mods entry.
+	entry   int
+	pattern string
+	src     gitSource
+	// module is empty for repositories which are covered, but no modules.
+	module string
+	// shadowedBy is the repository which provides module instead, if any.
+	shadowedBy *gitSource
+}
+
+// fetchMods lists the repositories of all mods entries and matches them against the patterns.
+// It also returns the repositories ignored as configured and why as well as all matches.
+func fetchMods(config *githubConfig, patterns map[string]*regexp.Regexp) (
+	hits map[string]gitSource, unknown map[unknownRepo]struct{}, ignored map[unknownRepo]string,
+	matches []modMatch,
 ) {
-	gh := github.NewClient(nil)
-	chUsers := make(chan githubUser, len(mods))
+	mods := config.Mods
+	forges := make([]forge, len(mods))
+
+	{
+		var gh *github.Client
+		for i := range mods {
+			if mods[i].Forge == "" || mods[i].Forge == forgeGitHub {
+				token, ok := readToken(config.Token, config.TokenFile)
+				if !ok {
+					return nil, nil, nil, nil
+				}
+
+				gh = newGitHubClient(token)
+				break
+			}
+		}
 
-	for _, mod := range mods {
-		go fetchUser(gh, mod.User, chUsers)
+		for i := range mods {
+			if forges[i] = newForge(&mods[i], gh); forges[i] == nil {
+				return nil, nil, nil, nil
+			}
+		}
+	}
+
+	chUsers := make(chan forgeUser, len(mods))
+
+	for i, mod := range mods {
+		go fetchUser(forges[i], i, mod.User, chUsers)
 	}
 
-	repos := make(map[string][]string, len(mods))
+	repos := make([][]forgeRepo, len(mods))
 
 	{
 		ok := true
@@ -229,109 +476,172 @@ func fetchMods(mods []modConfig, patterns map[string]*regexp.Regexp) (
 			if res := <-chUsers; res.repos == nil {
 				ok = false
 			} else {
-				repos[res.name] = res.repos
+				repos[res.idx] = res.repos
 			}
 		}
 
 		if !ok {
-			return nil, nil
+			return nil, nil, nil, nil
 		}
 	}
 
 	unknown = map[unknownRepo]struct{}{}
+	ignored = map[unknownRepo]string{}
+	names := make([][]string, len(mods))
+
+	for i, reposOfUser := range repos {
+		excludes := make([]*regexp.Regexp, 0, len(mods[i].Exclude))
+		for _, exclude := range mods[i].Exclude {
+			// Already validated along with the config.
+			excludes = append(excludes, regexp.MustCompile(exclude))
+		}
 
-	for user, reposOfUser := range repos {
 		for _, repo := range reposOfUser {
-			unknown[unknownRepo{user, repo}] = struct{}{}
+			if reason := ignoreReason(&mods[i], excludes, repo); reason != "" {
+				ignored[newUnknownRepo(forges[i], mods[i].User, repo.name)] = reason
+			} else {
+				names[i] = append(names[i], repo.name)
+				unknown[newUnknownRepo(forges[i], mods[i].User, repo.name)] = struct{}{}
+			}
 		}
 	}
 
-	reposOfMods := map[string]string{}
+	reposOfMods := map[string]gitSource{}
 
-	for _, mod := range mods {
-		ourRepos := repos[mod.User]
+	for i, mod := range mods {
+		ourRepos := names[i]
 
 		for _, repo := range mod.Repos {
 			rgx := patterns[repo]
 
 			for _, ourRepo := range ourRepos {
 				if match := rgx.FindStringSubmatch(ourRepo); match != nil {
+					hit := modMatch{entry: i, pattern: repo, src: gitSource{
+						repoOrigin{forges[i], mod.User, ourRepo},
+						forges[i].cloneURL(mod.User, ourRepo),
+						lookupModSetting(mod.Versions, match[1], ourRepo),
+						lookupModSetting(mod.Track, match[1], ourRepo),
+						repo,
+					}}
+
 					if strings.TrimSpace(match[1]) != "" {
-						if _, ok := reposOfMods[match[1]]; !ok {
-							reposOfMods[match[1]] = fmt.Sprintf("%s/%s", mod.User, ourRepo)
+						hit.module = match[1]
+
+						if winner, ok := reposOfMods[match[1]]; ok {
+							hit.shadowedBy = &winner
+						} else {
+							reposOfMods[match[1]] = hit.src
 						}
 					}
 
-					delete(unknown, unknownRepo{mod.User, ourRepo})
+					matches = append(matches, hit)
+					delete(unknown, newUnknownRepo(forges[i], mod.User, ourRepo))
 				}
 			}
 		}
 	}
 
-	return reposOfMods, unknown
+	return reposOfMods, unknown, ignored, matches
 }
 
-type githubUser struct {
-	name  string
-	repos []string
-}
+// ignoreReason tells why mod ignores repo, if it does.
+func ignoreReason(mod *modConfig, excludes []*regexp.Regexp, repo forgeRepo) string {
+	for _, name := range mod.Ignore {
+		if name == repo.name {
+			return "ignored"
+		}
+	}
 
-func fetchUser(gh *github.Client, user string, res chan<- githubUser) {
-	log.WithFields(log.Fields{"user": user}).Info("Fetching repos of GitHub user")
+	if mod.SkipArchived && repo.archived {
+		return "archived"
+	}
 
-	var names []string
+	if mod.SkipForks && repo.fork {
+		return "fork"
+	}
 
-	{
-		var opts = github.RepositoryListOptions{
-			Visibility:  "public",
-			ListOptions: github.ListOptions{PerPage: 100, Page: 1},
+	for _, exclude := range excludes {
+		if exclude.MatchString(repo.name) {
+			return "excluded by " + exclude.String()
 		}
+	}
 
-		for {
-			repos, _, errLR := gh.Repositories.List(background, user, &opts)
-			if errLR != nil {
-				log.WithFields(log.Fields{
-					"user": user, "error": jsonableError{errLR},
-				}).Error("Couldn't fetch repos of GitHub user")
+	return ""
+}
 
-				res <- githubUser{}
-			}
+// lookupModSetting looks up a per-module setting by module name, falling back to the repository name.
+func lookupModSetting(settings map[string]string, mod, repo string) string {
+	if setting, ok := settings[mod]; ok {
+		return setting
+	}
 
-			for _, repo := range repos {
-				names = append(names, *repo.Name)
-			}
+	return settings[repo]
+}
 
-			if len(repos) < opts.PerPage {
-				break
-			}
+type forgeUser struct {
+	idx   int
+	repos []forgeRepo
+}
 
-			opts.Page++
-		}
+func fetchUser(f forge, idx int, user string, res chan<- forgeUser) {
+	log.WithFields(log.Fields{"user": user}).Info("Fetching repos of user")
+
+	names, ok := f.listRepos(user)
+	if !ok {
+		res <- forgeUser{}
+		return
+	}
+
+	if names == nil {
+		names = []forgeRepo{}
 	}
 
-	sort.Strings(names)
-	res <- githubUser{user, names}
+	sort.Slice(names, func(i, j int) bool {
+		return names[i].name < names[j].name
+	})
+
+	res <- forgeUser{idx, names}
+}
+
+type tokenTransport struct {
+	auth string
+	next http.RoundTripper
 }
 
-func updateMirrors(expected map[string]string, res chan<- map[string]gitRepo) {
+var _ http.RoundTripper = tokenTransport{}
+
+func (tt tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", tt.auth)
+
+	return tt.next.RoundTrip(req)
+}
+
+func updateMirrors(expected map[string]gitSource, res chan<- map[string]gitRepo) {
 	if !mkDir(gitMirrorPath) {
 		res <- nil
 		return
 	}
 
 	chGit := make(chan gitRepo, len(expected))
-	for dir, repo := range expected {
-		go fetchGit(githubPrefix+repo+githubSuffix, path.Join(gitMirrorPath, dir), chGit)
+	for dir, src := range expected {
+		go fetchGit(src, path.Join(gitMirrorPath, dir), chGit)
 	}
 
 	ok := true
 	mirrors := make(map[string]gitRepo, len(expected))
 
 	for range expected {
-		if repo := <-chGit; repo == (gitRepo{}) {
+		if repo := <-chGit; repo.remote == "" {
 			ok = false
 		} else {
-			mirrors[strings.TrimSuffix(strings.TrimPrefix(repo.remote, githubPrefix), githubSuffix)] = repo
+			mirrors[repo.remote] = repo
+		}
+	}
+
+	for _, src := range expected {
+		if _, fetched := mirrors[src.remote]; !fetched {
+			metrics.fetchFailed(src.remote)
 		}
 	}
 
@@ -342,7 +652,7 @@ func updateMirrors(expected map[string]string, res chan<- map[string]gitRepo) {
 	res <- mirrors
 }
 
-func rmObsolete(expected map[string]string, done chan<- struct{}) {
+func rmObsolete(expected map[string]gitSource, done chan<- struct{}) {
 	defer close(done)
 
 	log.WithFields(log.Fields{"path": gitMirrorPath}).Trace("Listing dir")
@@ -374,6 +684,36 @@ func rmOne(dir string, wg *sync.WaitGroup) {
 	rmDir(dir, log.InfoLevel)
 }
 
+func mirrorDir(remote string) string {
+	return hex.EncodeToString([]byte(remote))
+}
+
+// adoptLegacyMirrors renames the mirrors of GitHub repositories from the time mirrors were named by owner/name
+// to their current names, so that they don't have to be cloned again.
+func adoptLegacyMirrors(expected map[string]gitSource) {
+	for dir, src := range expected {
+		if !strings.HasPrefix(src.remote, githubPrefix) || !strings.HasSuffix(src.remote, githubSuffix) {
+			continue
+		}
+
+		legacy := path.Join(gitMirrorPath, hex.EncodeToString([]byte(
+			strings.TrimSuffix(strings.TrimPrefix(src.remote, githubPrefix), githubSuffix),
+		)))
+		current := path.Join(gitMirrorPath, dir)
+
+		if _, errSt := os.Stat(current); !os.IsNotExist(errSt) {
+			continue
+		}
+
+		if _, errSt := os.Stat(legacy); errSt == nil {
+			log.WithFields(log.Fields{"remote": src.remote, "old": legacy, "new": current}).Info(
+				"Renaming mirror named the old way",
+			)
+			rename(legacy, current)
+		}
+	}
+}
+
 func mkTemp() string {
 	log.WithFields(log.Fields{"path": tempChild}).Trace("Creating temp dir")
 
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// lockChange is how a repository changed between two lockfiles.
+type lockChange struct {
+	name     string
+	old, new *lockedRepo
+}
+
+// compareURL returns the forge's URL comparing the old and new commit, if supported.
+func (lc *lockChange) compareURL() string {
+	if lc.old == nil || lc.new == nil || lc.new.forge == nil || lc.old.Remote != lc.new.Remote {
+		return ""
+	}
+
+	return lc.new.forge.compareURL(lc.new.Owner, lc.new.Repo, lc.old.Commit, lc.new.Commit)
+}
+
+// readLockfile reads a previously deployed lockfile. It reports a missing one as nil.
+func readLockfile(file string) (*lockfile, bool) {
+	log.WithFields(log.Fields{"file": file}).Trace("Reading lockfile")
+
+	raw, errRF := ioutil.ReadFile(file)
+	if errRF != nil {
+		if os.IsNotExist(errRF) {
+			return nil, true
+		}
+
+		log.WithFields(log.Fields{"file": file, "error": jsonableError{errRF}}).Error("Couldn't read lockfile")
+		return nil, false
+	}
+
+	lock := &lockfile{}
+	if errJU := json.Unmarshal(raw, lock); errJU != nil {
+		log.WithFields(log.Fields{"file": file, "error": jsonableError{errJU}}).Error("Couldn't parse lockfile")
+		return nil, false
+	}
+
+	return lock, true
+}
+
+// diffLockfiles lists the framework (named frameworkModName) and modules which changed from old to new.
+func diffLockfiles(old, new *lockfile) (changes []lockChange) {
+	if old.Framework.Commit != new.Framework.Commit || old.Framework.Remote != new.Framework.Remote {
+		changes = append(changes, lockChange{frameworkModName, &old.Framework, &new.Framework})
+	}
+
+	names := make([]string, 0, len(old.Modules)+len(new.Modules))
+	for name := range old.Modules {
+		names = append(names, name)
+	}
+
+	for name := range new.Modules {
+		if _, ok := old.Modules[name]; !ok {
+			names = append(names, name)
+		}
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		var change lockChange
+		change.name = name
+
+		if repo, ok := old.Modules[name]; ok {
+			change.old = &repo
+		}
+
+		if repo, ok := new.Modules[name]; ok {
+			change.new = &repo
+		}
+
+		if change.old == nil || change.new == nil ||
+			change.old.Commit != change.new.Commit || change.old.Remote != change.new.Remote {
+			changes = append(changes, change)
+		}
+	}
+
+	return
+}
+
+// isTag tells whether a tag (not a branch or commit) of the repository is locked.
+func (lr *lockedRepo) isTag() bool {
+	return lr.Tag != "HEAD" && !strings.HasPrefix(lr.Tag, "refs/") && !strings.HasPrefix(lr.Commit, lr.Tag)
+}
+
+// describe tells a human which version of the repository is locked.
+func (lr *lockedRepo) describe() string {
+	if !lr.isTag() {
+		return fmt.Sprintf("%s (%.7s)", strings.TrimPrefix(lr.Tag, "refs/heads/"), lr.Commit)
+	}
+
+	return lr.Tag
+}
+
+// releaseURL returns the forge's URL of the release notes of the locked tag, if supported.
+func (lr *lockedRepo) releaseURL() string {
+	if lr.forge == nil || !lr.isTag() {
+		return ""
+	}
+
+	return lr.forge.releaseURL(lr.Owner, lr.Repo, lr.Tag)
+}
+
+// renderChangelog renders changes in a human-readable way, e.g. as commit message body.
+func renderChangelog(changes []lockChange) string {
+	var added, removed, updated bytes.Buffer
+
+	for _, change := range changes {
+		switch {
+		case change.old == nil:
+			fmt.Fprintf(&added, "* %s %s\n", change.name, change.new.describe())
+		case change.new == nil:
+			fmt.Fprintf(&removed, "* %s %s\n", change.name, change.old.describe())
+		default:
+			fmt.Fprintf(&updated, "* %s: %s -> %s\n", change.name, change.old.describe(), change.new.describe())
+
+			if url := change.compareURL(); url != "" {
+				fmt.Fprintf(&updated, "  %s\n", url)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+
+	for _, section := range [3]struct {
+		title   string
+		content *bytes.Buffer
+	}{{"Updated", &updated}, {"Added", &added}, {"Removed", &removed}} {
+		if section.content.Len() > 0 {
+			if buf.Len() > 0 {
+				buf.WriteByte('\n')
+			}
+
+			fmt.Fprintf(&buf, "%s:\n", section.title)
+			buf.Write(section.content.Bytes())
+		}
+	}
+
+	return buf.String()
+}
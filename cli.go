@@ -0,0 +1,278 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	exitOK    = 0
+	exitFail  = 1
+	exitUsage = 2
+)
+
+// subcommands are the one-shot alternatives to running as daemon.
+var subcommands = map[string]func(args []string) int{
+	"build":      cmdBuild,
+	"deploy-now": cmdDeployNow,
+	"discover":   cmdDiscover,
+	"validate":   cmdValidate,
+}
+
+func runSubcommand(name string, args []string) int {
+	cmd, ok := subcommands[name]
+	if !ok {
+		names := make([]string, 0, len(subcommands))
+		for name := range subcommands {
+			names = append(names, name)
+		}
+
+		sort.Strings(names)
+		fmt.Fprintf(os.Stderr, "Unknown subcommand %q, expected one of: %s\n", name, strings.Join(names, ", "))
+
+		return exitUsage
+	}
+
+	return cmd(args)
+}
+
+// loadProfiles loads and validates the config like the daemon does.
+// It returns the profile called only (all of them if empty) and how many profiles there are.
+func loadProfiles(only string) (profiles []*profile, total int, patterns map[string]*regexp.Regexp, ok bool) {
+	patterns = map[string]*regexp.Regexp{}
+
+	var all []*profile
+	_, level, rejected := readConfig(patterns, &all)
+	if len(rejected) > 0 {
+		return
+	}
+
+	log.SetLevel(level)
+
+	if only == "" {
+		return all, len(all), patterns, true
+	}
+
+	for _, p := range all {
+		if p.name == only {
+			return []*profile{p}, len(all), patterns, true
+		}
+	}
+
+	log.WithFields(log.Fields{"profile": only}).Error("No such profile")
+	return nil, 0, nil, false
+}
+
+func newFlagSet(name string) (fs *flag.FlagSet, profile *string) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	profile = fs.String("profile", "", "only this profile (default: all)")
+
+	return
+}
+
+func parseFlags(fs *flag.FlagSet, args []string) bool {
+	if fs.Parse(args) != nil {
+		return false
+	}
+
+	if fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments: %s\n", strings.Join(fs.Args(), " "))
+		fs.Usage()
+		return false
+	}
+
+	return true
+}
+
+func cmdValidate(args []string) int {
+	if !parseFlags(flag.NewFlagSet("validate", flag.ContinueOnError), args) {
+		return exitUsage
+	}
+
+	if _, _, _, ok := loadProfiles(""); !ok {
+		return exitFail
+	}
+
+	log.Info("Config is valid")
+	return exitOK
+}
+
+func cmdBuild(args []string) int {
+	fs, only := newFlagSet("build")
+	dryRun := fs.Bool("dry-run", false, "print the script to stdout instead of deploying anything")
+
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	profiles, total, patterns, ok := loadProfiles(*only)
+	if !ok {
+		return exitFail
+	}
+
+	if *dryRun && len(profiles) > 1 {
+		log.Error("Multiple profiles configured, choose one via -profile")
+		return exitUsage
+	}
+
+	if !lockDataDir() {
+		return exitFail
+	}
+
+	// A dry run shall change as few as possible.
+	var mirrors *mirrorUsage
+	if !*dryRun {
+		mirrors = newMirrorUsage(total)
+	}
+
+	code := exitOK
+
+	for _, p := range profiles {
+		rmDir(tempDir, log.InfoLevel)
+		if !mkDir(tempDir) {
+			return exitFail
+		}
+
+		config := p.config
+
+		log.WithFields(log.Fields{"profile": p.name}).Info("Building")
+		res := build(p.name, &config.GitHub, patterns, config.Deploy.Fetch == fetchModeTarball, mirrors)
+		if res == nil {
+			code = exitFail
+			continue
+		}
+
+		files, lock := deployFiles(&config.Deploy, res)
+		if files == nil {
+			code = exitFail
+			continue
+		}
+
+		if *dryRun {
+			os.Stdout.Write(files[0].content)
+			continue
+		}
+
+		log.WithFields(log.Fields{"profile": p.name}).Info("Deploying")
+		if deploy(&config.Deploy, p.deployDir, files, lock, lastDeployed(p.name)) {
+			rememberDeployed(p.name, lock)
+		} else {
+			code = exitFail
+		}
+	}
+
+	return code
+}
+
+func cmdDeployNow(args []string) int {
+	fs, only := newFlagSet("deploy-now")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	profiles, total, patterns, ok := loadProfiles(*only)
+	if !ok || !lockDataDir() {
+		return exitFail
+	}
+
+	mirrors := newMirrorUsage(total)
+	code := exitOK
+
+	for _, p := range profiles {
+		if !buildProfile(p, triggerCLI, patterns, mirrors) {
+			code = exitFail
+		}
+	}
+
+	return code
+}
+
+func cmdDiscover(args []string) int {
+	fs, only := newFlagSet("discover")
+	if !parseFlags(fs, args) {
+		return exitUsage
+	}
+
+	profiles, _, patterns, ok := loadProfiles(*only)
+	if !ok {
+		return exitFail
+	}
+
+	for _, p := range profiles {
+		mods, unknown, ignored, matches := fetchMods(&p.config.GitHub, patterns)
+		if mods == nil {
+			return exitFail
+		}
+
+		type entryPattern struct {
+			entry   int
+			pattern string
+		}
+
+		byPattern := map[entryPattern][]string{}
+		for _, match := range matches {
+			src := &match.src
+			line := fmt.Sprintf("%s <- %s/%s (%s)", match.module, src.owner, src.name, src.remote)
+
+			switch {
+			case match.module == "":
+				line = fmt.Sprintf("(no module) %s/%s (%s)", src.owner, src.name, src.remote)
+			case match.shadowedBy != nil:
+				line += fmt.Sprintf(", shadowed by %s/%s", match.shadowedBy.owner, match.shadowedBy.name)
+			}
+
+			key := entryPattern{match.entry, match.pattern}
+			byPattern[key] = append(byPattern[key], line)
+		}
+
+		fmt.Printf("Profile %s:\n", p.name)
+
+		for i, mod := range p.config.GitHub.Mods {
+			for _, pattern := range mod.Repos {
+				if mod.User == "" {
+					fmt.Printf("  Pattern %s:\n", pattern)
+				} else {
+					fmt.Printf("  Pattern %s of %s:\n", pattern, mod.User)
+				}
+
+				for _, line := range byPattern[entryPattern{i, pattern}] {
+					fmt.Printf("    %s\n", line)
+				}
+
+				// Each pattern's matches are listed once, even if an entry lists the pattern multiple times.
+				delete(byPattern, entryPattern{i, pattern})
+			}
+		}
+
+		urls := make([]string, 0, len(ignored))
+		for repo, reason := range ignored {
+			urls = append(urls, fmt.Sprintf("%s (%s)", repo.URL, reason))
+		}
+
+		sort.Strings(urls)
+		fmt.Println("  Ignored:")
+
+		for _, url := range urls {
+			fmt.Printf("    %s\n", url)
+		}
+
+		urls = urls[:0]
+		for repo := range unknown {
+			urls = append(urls, repo.URL)
+		}
+
+		sort.Strings(urls)
+		fmt.Println("  Not covered by any pattern:")
+
+		for _, url := range urls {
+			fmt.Printf("    %s\n", url)
+		}
+	}
+
+	return exitOK
+}
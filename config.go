@@ -0,0 +1,764 @@
+package main
+
+import (
+	"fmt"
+	"github.com/hashicorp/go-version"
+	"github.com/robfig/cron/v3"
+	lev "github.com/schollz/closestmatch/levenshtein"
+	log "github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultProfile = "default"
+
+var profileName = regexp.MustCompile(`\A\w[\w.-]*\z`)
+var yamlErrorLine = regexp.MustCompile(`\Aline (\d+): (.+)\z`)
+
+// interpolation matches ${ENV}, ${file:/path} and the escaped $${ which stands for a literal ${.
+var interpolation = regexp.MustCompile(`\$\$\{|\$\{([^}]*)\}`)
+
+// configProblem is something wrong with config.yml.
+type configProblem struct {
+	// path leads to the offending value, e.g. github.mods.0.user.
+	path []string
+	// node is the offending YAML node, if already known.
+	node    *yaml.Node
+	message string
+	fields  log.Fields
+}
+
+// configProblems collects the problems of config.yml below a path.
+type configProblems struct {
+	path []string
+	all  *[]configProblem
+}
+
+func newConfigProblems() configProblems {
+	return configProblems{nil, &[]configProblem{}}
+}
+
+// at returns a collector of the problems below path (relative to cp).
+func (cp configProblems) at(path ...string) configProblems {
+	return configProblems{append(append([]string(nil), cp.path...), path...), cp.all}
+}
+
+// add records a problem with the value at path (relative to cp).
+func (cp configProblems) add(message string, fields log.Fields, path ...string) {
+	*cp.all = append(*cp.all, configProblem{cp.at(path...).path, nil, message, fields})
+}
+
+// addNode records a problem with node which is at path (relative to cp).
+func (cp configProblems) addNode(node *yaml.Node, message string, fields log.Fields, path ...string) {
+	*cp.all = append(*cp.all, configProblem{cp.at(path...).path, node, message, fields})
+}
+
+// report logs all problems, ordered by their position in root, and describes them human-readably.
+func (cp configProblems) report(root *yaml.Node) (described []string) {
+	type locatedProblem struct {
+		configProblem
+		line, column int
+	}
+
+	problems := make([]locatedProblem, 0, len(*cp.all))
+	for _, problem := range *cp.all {
+		node := problem.node
+		if node == nil && len(problem.path) > 0 {
+			node = locate(root, problem.path)
+		}
+
+		lp := locatedProblem{configProblem: problem}
+		if node != nil {
+			lp.line, lp.column = node.Line, node.Column
+		}
+
+		problems = append(problems, lp)
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool {
+		if problems[i].line == problems[j].line {
+			return problems[i].column < problems[j].column
+		}
+
+		return problems[i].line < problems[j].line
+	})
+
+	for _, problem := range problems {
+		fields := log.Fields{"path": configPath}
+		if len(problem.path) > 0 {
+			fields["key"] = strings.Join(problem.path, ".")
+		}
+
+		if problem.line > 0 {
+			fields["line"] = problem.line
+		}
+
+		if problem.column > 0 {
+			fields["column"] = problem.column
+		}
+
+		log.WithFields(problem.fields).WithFields(fields).Error(problem.message)
+		described = append(described, describeProblem(problem.message, problem.fields, fields))
+	}
+
+	return
+}
+
+// describeProblem renders a logged problem as one line, e.g. for notifications.
+func describeProblem(message string, fields, position log.Fields) string {
+	var where []string
+	if line, ok := position["line"]; ok {
+		where = append(where, fmt.Sprintf("line %v", line))
+	}
+
+	if column, ok := position["column"]; ok {
+		where = append(where, fmt.Sprintf("column %v", column))
+	}
+
+	if key, ok := position["key"]; ok {
+		where = append(where, fmt.Sprintf("key %v", key))
+	}
+
+	details := make([]string, 0, len(fields))
+	for name, value := range fields {
+		details = append(details, name+"="+fieldText(value))
+	}
+
+	sort.Strings(details)
+
+	described := message
+	if len(where) > 0 {
+		described = strings.Join(where, ", ") + ": " + described
+	}
+
+	if len(details) > 0 {
+		described += " (" + strings.Join(details, ", ") + ")"
+	}
+
+	return described
+}
+
+// locate returns the node at path in root or, if there's none, the one of its deepest existing parent.
+func locate(root *yaml.Node, path []string) *yaml.Node {
+	node := resolveNode(root)
+
+	for _, key := range path {
+		var next *yaml.Node
+
+		switch node.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					next = node.Content[i+1]
+				}
+			}
+		case yaml.SequenceNode:
+			if idx, errAt := strconv.Atoi(key); errAt == nil && idx >= 0 && idx < len(node.Content) {
+				next = node.Content[idx]
+			}
+		}
+
+		if next == nil {
+			break
+		}
+
+		node = resolveNode(next)
+	}
+
+	return node
+}
+
+// resolveNode skips documents and aliases.
+func resolveNode(node *yaml.Node) *yaml.Node {
+	for {
+		switch {
+		case node.Kind == yaml.DocumentNode && len(node.Content) > 0:
+			node = node.Content[0]
+		case node.Kind == yaml.AliasNode && node.Alias != nil:
+			node = node.Alias
+		default:
+			return node
+		}
+	}
+}
+
+// checkKeys reports keys in node not known to the type it's decoded into.
+func checkKeys(node *yaml.Node, typ reflect.Type, problems configProblems) {
+	node = resolveNode(node)
+
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	switch typ.Kind() {
+	case reflect.Struct:
+		if node.Kind != yaml.MappingNode {
+			return
+		}
+
+		fields := map[string]reflect.Type{}
+		yamlFields(typ, fields)
+
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+
+			if fieldType, ok := fields[key.Value]; ok {
+				checkKeys(value, fieldType, problems.at(key.Value))
+			} else if key.Value == "<<" {
+				checkKeys(value, typ, problems)
+			} else {
+				names := make([]string, 0, len(fields))
+				for name := range fields {
+					names = append(names, name)
+				}
+
+				sort.Strings(names)
+
+				problems.addNode(key, "Unknown config key", log.Fields{
+					"bad_key": key.Value, "did_you_mean": lev.New(names).Closest(key.Value),
+				}, key.Value)
+			}
+		}
+	case reflect.Map:
+		if node.Kind == yaml.MappingNode {
+			for i := 0; i+1 < len(node.Content); i += 2 {
+				checkKeys(node.Content[i+1], typ.Elem(), problems.at(node.Content[i].Value))
+			}
+		}
+	case reflect.Slice:
+		if node.Kind == yaml.SequenceNode {
+			for i, item := range node.Content {
+				checkKeys(item, typ.Elem(), problems.at(strconv.Itoa(i)))
+			}
+		}
+	}
+}
+
+// yamlFields maps the YAML keys of struct typ to their field types.
+func yamlFields(typ reflect.Type, fields map[string]reflect.Type) {
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+
+		if tag[0] == "-" {
+			continue
+		}
+
+		inline := false
+		for _, opt := range tag[1:] {
+			if opt == "inline" {
+				inline = true
+			}
+		}
+
+		switch {
+		case inline:
+			yamlFields(field.Type, fields)
+		case field.PkgPath != "":
+		case tag[0] == "":
+			fields[strings.ToLower(field.Name)] = field.Type
+		default:
+			fields[tag[0]] = field.Type
+		}
+	}
+}
+
+// readConfig loads config.yml, validates it, compiles the patterns it uses and appends its profiles.
+// It logs all problems found and describes them as rejected. The config is valid if there are none.
+func readConfig(
+	patterns map[string]*regexp.Regexp, profiles *[]*profile,
+) (config *configuration, level log.Level, rejected []string) {
+	root, problem := loadConfig()
+	if root == nil {
+		return nil, 0, []string{problem}
+	}
+
+	config = &configuration{secretFiles: map[string]struct{}{}}
+	problems := newConfigProblems()
+
+	interpolate(root, config.secretFiles, problems)
+	checkKeys(root, reflect.TypeOf(config), problems)
+
+	if root.Kind != 0 {
+		if errDc := root.Decode(config); errDc != nil {
+			if typeErr, ok := errDc.(*yaml.TypeError); ok {
+				for _, msg := range typeErr.Errors {
+					if match := yamlErrorLine.FindStringSubmatch(msg); match != nil {
+						line, _ := strconv.Atoi(match[1])
+						problems.addNode(&yaml.Node{Line: line}, "Bad config value", log.Fields{"error": match[2]})
+					} else {
+						problems.add("Bad config value", log.Fields{"error": msg})
+					}
+				}
+			} else {
+				problems.add("Couldn't decode config", log.Fields{"error": jsonableError{errDc}})
+			}
+		}
+	}
+
+	level = validateConfig(config, patterns, profiles, problems)
+	rejected = problems.report(root)
+
+	return
+}
+
+// loadConfig parses config.yml. On failure it describes why instead.
+func loadConfig() (root *yaml.Node, problem string) {
+	log.WithFields(log.Fields{"path": configPath}).Info("Loading config")
+
+	raw, errRF := ioutil.ReadFile(configPath)
+	if errRF != nil {
+		log.WithFields(log.Fields{"path": configPath, "error": jsonableError{errRF}}).Error("Couldn't read config")
+		return nil, "Couldn't read config: " + errRF.Error()
+	}
+
+	root = &yaml.Node{}
+	if errYU := yaml.Unmarshal(raw, root); errYU != nil {
+		log.WithFields(log.Fields{"path": configPath, "error": jsonableError{errYU}}).Error("Couldn't parse config")
+		return nil, "Couldn't parse config: " + errYU.Error()
+	}
+
+	return
+}
+
+// interpolate replaces ${ENV} and ${file:/path} in all scalar values below node and records the files read.
+func interpolate(node *yaml.Node, files map[string]struct{}, problems configProblems) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			interpolate(child, files, problems)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			interpolate(node.Content[i+1], files, problems.at(node.Content[i].Value))
+		}
+	case yaml.SequenceNode:
+		for i, item := range node.Content {
+			interpolate(item, files, problems.at(strconv.Itoa(i)))
+		}
+	case yaml.ScalarNode:
+		node.Value = interpolation.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			if ref == "$${" {
+				return "${"
+			}
+
+			name := ref[2 : len(ref)-1]
+
+			if strings.HasPrefix(name, "file:") {
+				file := path.Clean(strings.TrimPrefix(name, "file:"))
+				files[file] = struct{}{}
+
+				raw, errRF := ioutil.ReadFile(file)
+				if errRF != nil {
+					problems.addNode(node, "Couldn't read interpolated file", log.Fields{
+						"file": file, "error": jsonableError{errRF},
+					})
+					return ""
+				}
+
+				return strings.TrimSpace(string(raw))
+			}
+
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				problems.addNode(node, "Interpolated environment variable not set", log.Fields{"variable": name})
+			}
+
+			return value
+		})
+	}
+}
+
+// validateConfig validates config, compiles the patterns it uses and appends its profiles.
+func validateConfig(
+	config *configuration, patterns map[string]*regexp.Regexp, profiles *[]*profile, problems configProblems,
+) (level log.Level) {
+	if config.Log.Level == "" {
+		config.Log.Level = "info"
+	}
+
+	{
+		var errPL error
+		if level, errPL = log.ParseLevel(config.Log.Level); errPL != nil {
+			problems.add("Bad log level", log.Fields{
+				"bad_level": config.Log.Level, "did_you_mean": jsonableBadLogLevelAlt{config.Log.Level},
+			}, "log", "level")
+		}
+	}
+
+	if config.HTTP.Token != "" && config.HTTP.TokenFile != "" {
+		problems.add("API token given both directly and as file", nil, "http")
+	} else if config.HTTP.TokenFile != "" {
+		if token, ok := readToken("", config.HTTP.TokenFile); !ok {
+			problems.add("Unreadable API token file", log.Fields{
+				"file": config.HTTP.TokenFile,
+			}, "http", "token_file")
+		} else if token == "" {
+			problems.add("Empty API token file", log.Fields{"file": config.HTTP.TokenFile}, "http", "token_file")
+		}
+	}
+
+	if webhook := &config.HTTP.Webhook; webhook.Secret != "" && webhook.SecretFile != "" {
+		problems.add("Webhook secret given both directly and as file", nil, "http", "webhook")
+	} else if webhook.SecretFile != "" {
+		if secret, ok := readToken("", webhook.SecretFile); !ok {
+			problems.add("Unreadable webhook secret file", log.Fields{
+				"file": webhook.SecretFile,
+			}, "http", "webhook", "secret_file")
+		} else if secret == "" {
+			problems.add("Empty webhook secret file", log.Fields{
+				"file": webhook.SecretFile,
+			}, "http", "webhook", "secret_file")
+		}
+	}
+
+	if config.HTTP.Webhook.Debounce != "" {
+		if debounce, errPD := time.ParseDuration(config.HTTP.Webhook.Debounce); errPD != nil {
+			problems.add("Bad webhook debounce time", log.Fields{
+				"bad_debounce": config.HTTP.Webhook.Debounce, "error": jsonableError{errPD},
+			}, "http", "webhook", "debounce")
+		} else if debounce < 0 {
+			problems.add("Negative webhook debounce time", log.Fields{
+				"bad_debounce": config.HTTP.Webhook.Debounce,
+			}, "http", "webhook", "debounce")
+		}
+	}
+
+	if len(config.Profiles) < 1 {
+		*profiles = append(*profiles, &profile{
+			defaultProfile, &config.profileConfig, deployGitPath,
+			validateProfile(&config.profileConfig, patterns, problems), time.Time{},
+		})
+		return
+	}
+
+	if !reflect.DeepEqual(config.profileConfig, profileConfig{}) {
+		problems.add("Profiles given along with top-level build, github, deploy or notify", nil, "profiles")
+	}
+
+	names := map[string]struct{}{}
+
+	for i := range config.Profiles {
+		named := &config.Profiles[i]
+		at := problems.at("profiles", strconv.Itoa(i))
+
+		if !profileName.MatchString(named.Name) {
+			at.add("Bad profile name", log.Fields{"bad_name": named.Name}, "name")
+		} else if _, seen := names[named.Name]; seen {
+			at.add("Profile name used multiple times", log.Fields{"name": named.Name}, "name")
+		}
+
+		names[named.Name] = struct{}{}
+
+		*profiles = append(*profiles, &profile{
+			named.Name, &named.profileConfig, path.Join(profileDeployPath, named.Name),
+			validateProfile(&named.profileConfig, patterns, at), time.Time{},
+		})
+	}
+
+	return
+}
+
+// validateProfile validates config and compiles the patterns it uses.
+func validateProfile(
+	config *profileConfig, patterns map[string]*regexp.Regexp, problems configProblems,
+) (schedule cron.Schedule) {
+	if strings.TrimSpace(config.Build.Every) == "" {
+		problems.add("Build schedule missing", nil, "build", "every")
+	} else {
+		var errCP error
+		if schedule, errCP = cronParser.Parse(config.Build.Every); errCP != nil {
+			problems.add("Bad build schedule", log.Fields{
+				"bad_schedule": config.Build.Every, "error": jsonableError{errCP},
+			}, "build", "every")
+		}
+	}
+
+	gh := problems.at("github")
+
+	if config.GitHub.Token != "" && config.GitHub.TokenFile != "" {
+		gh.add("GitHub token given both directly and as file", nil)
+	}
+
+	if strings.TrimSpace(config.GitHub.Framework) == "" {
+		gh.add("Icinga Web 2 repository missing", nil, "framework")
+	}
+
+	switch config.GitHub.FrameworkForge {
+	case "", forgeGitHub:
+	case forgeGitLab, forgeGitea, forgeStatic:
+		if strings.TrimSpace(config.GitHub.FrameworkURL) == "" {
+			gh.add("Icinga Web 2 forge URL missing", nil, "framework_url")
+		}
+	default:
+		gh.add("Bad forge", log.Fields{"bad_forge": config.GitHub.FrameworkForge}, "framework_forge")
+	}
+
+	if config.GitHub.FrameworkVersion != "" {
+		if _, errNC := version.NewConstraint(config.GitHub.FrameworkVersion); errNC != nil {
+			gh.add("Bad version constraint", log.Fields{
+				"bad_constraint": config.GitHub.FrameworkVersion, "error": jsonableError{errNC},
+			}, "framework_version")
+		}
+	}
+
+	validateTrack(config.GitHub.FrameworkTrack, config.GitHub.FrameworkVersion, gh.at("framework_track"))
+
+	for i, mod := range config.GitHub.Mods {
+		at := gh.at("mods", strconv.Itoa(i))
+
+		for name, track := range mod.Track {
+			validateTrack(track, lookupModSetting(mod.Versions, name, ""), at.at("track", name))
+		}
+
+		for name, constraint := range mod.Versions {
+			if _, errNC := version.NewConstraint(constraint); errNC != nil {
+				at.add("Bad version constraint", log.Fields{
+					"bad_constraint": constraint, "error": jsonableError{errNC},
+				}, "versions", name)
+			}
+		}
+
+		if _, known := forgeKinds[mod.Forge]; !known && mod.Forge != "" {
+			at.add("Bad forge", log.Fields{"bad_forge": mod.Forge}, "forge")
+		}
+
+		switch mod.Forge {
+		case forgeGitLab, forgeGitea:
+			if strings.TrimSpace(mod.URL) == "" {
+				at.add("Forge URL missing", nil, "url")
+			}
+		case forgeStatic:
+			if len(mod.List) == 0 {
+				at.add("Repository list missing", nil, "list")
+			}
+		}
+
+		if mod.Token != "" && mod.TokenFile != "" {
+			at.add("Forge token given both directly and as file", nil)
+		}
+
+		if strings.TrimSpace(mod.User) == "" && mod.Forge != forgeStatic {
+			at.add("Organization missing", nil, "user")
+		}
+
+		for j, exclude := range mod.Exclude {
+			if _, errRC := regexp.Compile(exclude); errRC != nil {
+				at.add("Bad exclude pattern", log.Fields{
+					"bad_pattern": exclude, "error": jsonableError{errRC},
+				}, "exclude", strconv.Itoa(j))
+			}
+		}
+
+		for j, name := range mod.Ignore {
+			if strings.TrimSpace(name) == "" {
+				at.add("Empty repository name to ignore", nil, "ignore", strconv.Itoa(j))
+			}
+		}
+
+		if mod.Forge == forgeStatic {
+			if mod.SkipArchived {
+				at.add("Static repository lists don't know archived repositories", nil, "skip_archived")
+			}
+
+			if mod.SkipForks {
+				at.add("Static repository lists don't know forks", nil, "skip_forks")
+			}
+		}
+
+		if len(mod.Repos) == 0 {
+			at.add("Repository patterns missing", nil, "repos")
+		} else {
+			for j, repo := range mod.Repos {
+				rgx, seen := patterns[repo]
+				if !seen {
+					var errRC error
+					if rgx, errRC = regexp.Compile(repo); errRC != nil {
+						at.add("Bad repository pattern", log.Fields{
+							"bad_pattern": repo, "error": jsonableError{errRC},
+						}, "repos", strconv.Itoa(j))
+					} else if rgx.NumSubexp() != 1 {
+						at.add("Repository pattern with not exactly one subpattern", log.Fields{
+							"bad_pattern": repo, "subpatterns": rgx.NumSubexp(),
+						}, "repos", strconv.Itoa(j))
+
+						rgx = nil
+					}
+
+					patterns[repo] = rgx
+				} else if rgx == nil {
+					at.add("Bad repository pattern", log.Fields{"bad_pattern": repo}, "repos", strconv.Itoa(j))
+				}
+			}
+		}
+	}
+
+	dp := problems.at("deploy")
+
+	if strings.TrimSpace(config.Deploy.Remote) == "" {
+		dp.add("Deploy repository missing", nil, "remote")
+	}
+
+	if strings.TrimSpace(config.Deploy.Script) == "" {
+		dp.add("Deploy path missing", nil, "script")
+	}
+
+	if strings.TrimSpace(config.Deploy.Commit) == "" {
+		dp.add("Deploy commit message missing", nil, "commit")
+	}
+
+	if config.Deploy.Template != "" {
+		if _, errLT := loadScriptTemplate(config.Deploy.Template, ""); errLT != nil {
+			dp.add("Unusable script template", log.Fields{
+				"file": config.Deploy.Template, "error": jsonableError{errLT},
+			}, "template")
+		}
+	}
+
+	switch config.Deploy.Fetch {
+	case "", fetchModeGit, fetchModeTarball:
+	default:
+		dp.add("Bad fetch mode", log.Fields{"bad_fetch": config.Deploy.Fetch}, "fetch")
+	}
+
+	switch config.Deploy.Docker.Base {
+	case "", dockerBaseApache, dockerBaseFPM:
+	default:
+		dp.add("Bad Docker base image", log.Fields{"bad_base": config.Deploy.Docker.Base}, "docker", "base")
+	}
+
+	if pr := &config.Deploy.PullRequest; pr.Forge != "" {
+		at := dp.at("pull_request")
+
+		switch pr.Forge {
+		case forgeGitHub:
+		case forgeGitLab, forgeGitea:
+			if strings.TrimSpace(pr.URL) == "" {
+				at.add("Pull request forge URL missing", nil, "url")
+			}
+		default:
+			at.add("Bad pull request forge", log.Fields{"bad_forge": pr.Forge}, "forge")
+		}
+
+		if repo := strings.Split(pr.Repo, "/"); len(repo) != 2 || repo[0] == "" || repo[1] == "" {
+			at.add("Pull request repository not owner/name", log.Fields{"bad_repo": pr.Repo}, "repo")
+		}
+
+		if pr.Token == "" && pr.TokenFile == "" {
+			at.add("Pull request forge token missing", nil)
+		} else if pr.Token != "" && pr.TokenFile != "" {
+			at.add("Pull request forge token given both directly and as file", nil)
+		}
+	}
+
+	{
+		deployPaths := map[string]struct{}{path.Clean(config.Deploy.Script): {}}
+		addPath := func(file string, key ...string) {
+			if file != "" {
+				if _, seen := deployPaths[path.Clean(file)]; seen {
+					dp.add("Deploy path used multiple times", log.Fields{"file": file}, key...)
+				}
+
+				deployPaths[path.Clean(file)] = struct{}{}
+			}
+		}
+
+		addPath(config.Deploy.Lockfile, "lockfile")
+		addPath(config.Deploy.Docker.Dockerfile, "docker", "dockerfile")
+	}
+
+	validateNotify(&config.Notify, problems.at("notify"))
+
+	return
+}
+
+// validateNotify validates the notification channels of config.
+func validateNotify(config *notifyConfig, problems configProblems) {
+	if config.Digest != "" {
+		if _, errCP := cronParser.Parse(config.Digest); errCP != nil {
+			problems.add("Bad digest schedule", log.Fields{
+				"bad_schedule": config.Digest, "error": jsonableError{errCP},
+			}, "digest")
+		}
+	}
+
+	if config.FailureRepeat != "" {
+		if _, errPD := time.ParseDuration(config.FailureRepeat); errPD != nil {
+			problems.add("Bad failure notification repeat time", log.Fields{
+				"bad_repeat": config.FailureRepeat, "error": jsonableError{errPD},
+			}, "failure_repeat")
+		}
+	}
+
+	if sc := &config.SMTP; !reflect.DeepEqual(*sc, smtpConfig{}) {
+		at := problems.at("smtp")
+
+		if _, _, errSH := net.SplitHostPort(sc.Server); errSH != nil {
+			at.add("SMTP server not host:port", log.Fields{
+				"bad_server": sc.Server, "error": jsonableError{errSH},
+			}, "server")
+		}
+
+		if sc.Password != "" && sc.PasswordFile != "" {
+			at.add("SMTP password given both directly and as file", nil)
+		} else if sc.PasswordFile != "" {
+			if _, ok := readToken("", sc.PasswordFile); !ok {
+				at.add("Unreadable SMTP password file", log.Fields{"file": sc.PasswordFile}, "password_file")
+			}
+		}
+
+		if strings.TrimSpace(sc.From) == "" {
+			at.add("SMTP sender missing", nil, "from")
+		}
+
+		if len(sc.To) < 1 {
+			at.add("SMTP recipients missing", nil, "to")
+		}
+	}
+
+	for i, uri := range config.Webhooks {
+		validateNotifyURL(uri, problems.at("webhooks", strconv.Itoa(i)))
+	}
+
+	for i, chat := range config.Slack {
+		validateNotifyURL(chat.URL, problems.at("slack", strconv.Itoa(i), "url"))
+	}
+
+	if mc := &config.Matrix; !reflect.DeepEqual(*mc, matrixConfig{}) {
+		at := problems.at("matrix")
+
+		validateNotifyURL(mc.Homeserver, at.at("homeserver"))
+
+		if mc.Token == "" && mc.TokenFile == "" {
+			at.add("Matrix access token missing", nil)
+		} else if mc.Token != "" && mc.TokenFile != "" {
+			at.add("Matrix access token given both directly and as file", nil)
+		} else if mc.TokenFile != "" {
+			if token, ok := readToken("", mc.TokenFile); !ok {
+				at.add("Unreadable Matrix access token file", log.Fields{"file": mc.TokenFile}, "token_file")
+			} else if token == "" {
+				at.add("Empty Matrix access token file", log.Fields{"file": mc.TokenFile}, "token_file")
+			}
+		}
+
+		if len(mc.Rooms) < 1 {
+			at.add("Matrix rooms missing", nil, "rooms")
+		}
+	}
+}
+
+func validateNotifyURL(uri string, problems configProblems) {
+	if parsed, errPU := url.Parse(uri); errPU != nil || parsed.Scheme != "http" && parsed.Scheme != "https" {
+		problems.add("Bad notification URL", log.Fields{"bad_url": uri})
+	}
+}
@@ -1,88 +1,267 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
 	"os"
 	"path"
+	"strings"
 )
 
-func deploy(config *deployConfig, script []byte) {
+const defaultBranchPrefix = "dockerweb2/"
+
+// deployFile is a file to commit to the deploy repository.
+type deployFile struct {
+	path    string
+	content []byte
+	perm    os.FileMode
+}
+
+// deployFiles returns the files to deploy for res as configured and the lockfile describing res.
+// The latter is only among the former if configured.
+func deployFiles(config *deployConfig, res *buildResult) ([]deployFile, *lockfile) {
+	script, ok := renderScript(config.Template, config.Fetch, res)
+	if !ok {
+		return nil, nil
+	}
+
+	lock, ok := newLockfile(res)
+	if !ok {
+		return nil, nil
+	}
+
+	files := []deployFile{{config.Script, script, 0755}}
+
+	if config.Lockfile != "" {
+		raw, ok := lock.marshal()
+		if !ok {
+			return nil, nil
+		}
+
+		files = append(files, deployFile{config.Lockfile, raw, 0644})
+	}
+
+	if config.Docker.Dockerfile != "" {
+		files = append(files, deployFile{
+			config.Docker.Dockerfile, renderDockerfile(&config.Docker, config.Script, res), 0644,
+		})
+	}
+
+	return files, lock
+}
+
+// deploy commits files to the deploy repository cloned to dir and pushes them. The commit message describes
+// the changes since the lockfile in that repository or, if none, since previous (if any).
+func deploy(config *deployConfig, dir string, files []deployFile, lock, previous *lockfile) bool {
 	gitConfig := make([]string, 0, len(config.Config)*2)
 	for k, v := range config.Config {
 		gitConfig = append(gitConfig, "-c", fmt.Sprintf("%s=%s", k, v))
 	}
 
-	log.WithFields(log.Fields{"remote": config.Remote, "local": deployGitPath}).Info("Pulling Git repo")
+	log.WithFields(log.Fields{"remote": config.Remote, "local": dir}).Info("Pulling Git repo")
 
-	if _, errSt := os.Stat(deployGitPath); errSt != nil {
+	if _, errSt := os.Stat(dir); errSt != nil {
 		if os.IsNotExist(errSt) {
-			log.WithFields(log.Fields{"local": deployGitPath}).Debug("Cloning Git repo")
+			log.WithFields(log.Fields{"local": dir}).Debug("Cloning Git repo")
 
 			git := mkTemp()
 			if git == "" {
-				return
+				return false
 			}
 
 			defer rmDir(git, log.TraceLevel)
 
 			if _, ok := runCmd("git", append(gitConfig, "clone", "--", config.Remote, git)...); !ok {
-				return
+				return false
 			}
 
-			if !rename(git, deployGitPath) {
-				return
+			if !mkDir(path.Dir(dir)) || !rename(git, dir) {
+				return false
 			}
 		} else {
-			log.WithFields(log.Fields{"path": deployGitPath, "error": jsonableError{errSt}}).Error("Stat error")
-			return
+			log.WithFields(log.Fields{"path": dir, "error": jsonableError{errSt}}).Error("Stat error")
+			return false
 		}
 	}
 
 	{
 		_, ok := runCmd(
 			"git",
-			append(gitConfig, "-C", deployGitPath, "remote", "set-url", "--", "origin", config.Remote)...,
+			append(gitConfig, "-C", dir, "remote", "set-url", "--", "origin", config.Remote)...,
 		)
 		if !ok {
-			return
+			return false
 		}
 	}
 
-	if _, ok := runCmd("git", append(gitConfig, "-C", deployGitPath, "reset", "--hard")...); !ok {
-		return
+	if _, ok := runCmd("git", append(gitConfig, "-C", dir, "reset", "--hard")...); !ok {
+		return false
 	}
 
-	if _, ok := runCmd("git", append(gitConfig, "-C", deployGitPath, "pull", "--rebase")...); !ok {
-		return
+	prConfig := &config.PullRequest
+	base := prConfig.Base
+
+	if prConfig.Forge == "" {
+		if _, ok := runCmd("git", append(gitConfig, "-C", dir, "pull", "--rebase")...); !ok {
+			return false
+		}
+	} else {
+		if _, ok := runCmd("git", append(gitConfig, "-C", dir, "fetch", "--prune", "origin")...); !ok {
+			return false
+		}
+
+		if base == "" {
+			head, ok := runCmd(
+				"git", append(gitConfig, "-C", dir, "symbolic-ref", "--short", "refs/remotes/origin/HEAD")...,
+			)
+			if !ok {
+				return false
+			}
+
+			base = strings.TrimPrefix(string(bytes.TrimSpace(head)), "origin/")
+		}
+
+		if _, ok := runCmd(
+			"git", append(gitConfig, "-C", dir, "checkout", "-B", base, "origin/"+base)...,
+		); !ok {
+			return false
+		}
 	}
 
-	if !writeFile(path.Join(deployGitPath, config.Script), script) {
-		return
+	commitMsg := []string{"-m", config.Commit}
+	changelog := ""
+
+	if lock != nil {
+		oldLock := previous
+		if config.Lockfile != "" {
+			if deployed, ok := readLockfile(path.Join(dir, config.Lockfile)); ok && deployed != nil {
+				oldLock = deployed
+			}
+		}
+
+		if oldLock != nil {
+			if changelog = renderChangelog(diffLockfiles(oldLock, lock)); changelog != "" {
+				commitMsg = append(commitMsg, "-m", changelog)
+			}
+		}
 	}
 
-	if _, ok := runCmd("git", append(gitConfig, "-C", deployGitPath, "add", "--", config.Script)...); !ok {
-		return
+	paths := make([]string, 0, len(files))
+	for _, file := range files {
+		if !writeFile(path.Join(dir, file.path), file.content, file.perm) {
+			return false
+		}
+
+		paths = append(paths, file.path)
 	}
 
-	if status, ok := runCmd("git", append(gitConfig, "-C", deployGitPath, "status", "-s")...); ok {
+	if _, ok := runCmd("git", append(append(gitConfig, "-C", dir, "add", "--"), paths...)...); !ok {
+		return false
+	}
+
+	if status, ok := runCmd("git", append(gitConfig, "-C", dir, "status", "-s")...); ok {
 		if len(status) > 0 {
-			if _, ok := runCmd("git", append(gitConfig, "-C", deployGitPath, "commit", "-m", config.Commit)...); !ok {
-				return
+			if _, ok := runCmd("git", append(append(gitConfig, "-C", dir, "commit"), commitMsg...)...); !ok {
+				return false
 			}
+		} else if prConfig.Forge != "" {
+			log.Info("Nothing changed, not opening a pull request")
+			return closeStalePR(prConfig, base)
 		}
 	} else {
-		return
+		return false
+	}
+
+	if prConfig.Forge == "" {
+		_, ok := runCmd("git", append(gitConfig, "-C", dir, "push")...)
+		return ok
+	}
+
+	return deployPR(prConfig, gitConfig, dir, base, files, config.Commit, changelog)
+}
+
+// deployPR pushes the HEAD of the deploy repository in dir to the branch of the bot's open pull request
+// into base (or to a new one) and updates (or opens) that pull request.
+func deployPR(
+	config *pullRequestConfig, gitConfig []string, dir, base string, files []deployFile, title, changelog string,
+) bool {
+	prs := newPullRequester(config)
+	if prs == nil {
+		return false
+	}
+
+	prefix := config.BranchPrefix
+	if prefix == "" {
+		prefix = defaultBranchPrefix
+	}
+
+	id, branch, ok := prs.findPR(base, prefix)
+	if !ok {
+		return false
+	}
+
+	if id == 0 {
+		digest := sha256.New()
+		for _, file := range files {
+			digest.Write(file.content)
+		}
+
+		branch = prefix + hex.EncodeToString(digest.Sum(nil))[:12]
+	}
+
+	if _, ok := runCmd(
+		"git", append(gitConfig, "-C", dir, "push", "--force", "origin", "HEAD:refs/heads/"+branch)...,
+	); !ok {
+		return false
+	}
+
+	body := changelog
+	if body == "" {
+		body = "Automated update by dockerweb2."
+	}
+
+	if id == 0 {
+		log.WithFields(log.Fields{"branch": branch, "base": base}).Info("Opening pull request")
+		return prs.createPR(base, branch, title, body)
+	}
+
+	log.WithFields(log.Fields{"branch": branch, "base": base, "id": id}).Info("Updating pull request")
+	return prs.updatePR(id, title, body)
+}
+
+// closeStalePR closes the bot's open pull request into base, if any, as base is up to date already.
+func closeStalePR(config *pullRequestConfig, base string) bool {
+	prs := newPullRequester(config)
+	if prs == nil {
+		return false
+	}
+
+	prefix := config.BranchPrefix
+	if prefix == "" {
+		prefix = defaultBranchPrefix
+	}
+
+	id, branch, ok := prs.findPR(base, prefix)
+	if !ok {
+		return false
+	}
+
+	if id == 0 {
+		return true
 	}
 
-	runCmd("git", append(gitConfig, "-C", deployGitPath, "push")...)
+	log.WithFields(log.Fields{"branch": branch, "base": base, "id": id}).Info("Closing stale pull request")
+	return prs.closePR(id)
 }
 
-func writeFile(path string, content []byte) bool {
+func writeFile(path string, content []byte, perm os.FileMode) bool {
 	log.WithFields(log.Fields{"file": path}).Trace("Writing file")
 
-	if errWF := ioutil.WriteFile(path, content, 0755); errWF != nil {
+	if errWF := ioutil.WriteFile(path, content, perm); errWF != nil {
 		log.WithFields(log.Fields{"file": path, "error": jsonableError{errWF}}).Error("Couldn't write file")
 		return false
 	}
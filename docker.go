@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	dockerBaseApache = "apache"
+	dockerBaseFPM    = "fpm"
+)
+
+const dockerInstallPath = "/usr/share/icingaweb2"
+
+// renderDockerfile renders a Dockerfile which runs the script at scriptPath (relative to the build context)
+// and installs the resulting tree into a PHP image.
+func renderDockerfile(config *dockerConfig, scriptPath string, res *buildResult) []byte {
+	base := config.Base
+	if base == "" {
+		base = dockerBaseApache
+	}
+
+	image := "php:" + base
+	if config.PHP != "" {
+		image = fmt.Sprintf("php:%s-%s", config.PHP, base)
+	}
+
+	var buf bytes.Buffer
+
+	fmt.Fprintf(
+		&buf,
+		`# Generated by dockerweb2, don't edit manually
+
+FROM alpine AS fetch
+
+RUN apk add --no-cache git tar
+WORKDIR /src
+COPY [%s, "/src/get-iw2.sh"]
+RUN sh /src/get-iw2.sh
+
+
+FROM %s
+`,
+		strconv.Quote(scriptPath), image,
+	)
+
+	if len(config.Extensions) > 0 {
+		fmt.Fprintf(
+			&buf,
+			`
+COPY --from=mlocati/php-extension-installer /usr/bin/install-php-extensions /usr/local/bin/
+RUN install-php-extensions %s
+`,
+			strings.Join(config.Extensions, " "),
+		)
+	}
+
+	fmt.Fprintf(&buf, "\nCOPY --from=fetch /src/icingaweb2 %s\n", dockerInstallPath)
+
+	if base == dockerBaseApache {
+		fmt.Fprintf(
+			&buf,
+			`
+ENV APACHE_DOCUMENT_ROOT %s/public
+RUN sed -ri -e 's!/var/www/html!${APACHE_DOCUMENT_ROOT}!g' /etc/apache2/sites-available/*.conf /etc/apache2/conf-available/*.conf ;\
+	a2enmod rewrite
+`,
+			dockerInstallPath,
+		)
+	}
+
+	fmt.Fprintf(
+		&buf,
+		"\nLABEL dockerweb2.icingaweb2.ref=%s \\\n\tdockerweb2.icingaweb2.commit=%s",
+		strconv.Quote(res.framework.ref), strconv.Quote(res.framework.commit),
+	)
+
+	for _, mod := range sortedModNames(res.mods) {
+		repo := res.mods[mod]
+		fmt.Fprintf(
+			&buf,
+			" \\\n\tdockerweb2.module.%s.ref=%s \\\n\tdockerweb2.module.%s.commit=%s",
+			mod, strconv.Quote(repo.ref), mod, strconv.Quote(repo.commit),
+		)
+	}
+
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
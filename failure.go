@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultFailureRepeat = 24 * time.Hour
+
+// maxFailureField limits how much of e.g. a command's stderr a notification includes.
+const maxFailureField = 4096
+
+// failures collects the errors logged during a build to notify about them if the build fails.
+var failures = &failureCollector{notified: map[string]failureNotice{}}
+
+type failureCollector struct {
+	sync.Mutex
+
+	active   bool
+	phase    string
+	entries  []failureEntry
+	notified map[string]failureNotice
+}
+
+var _ log.Hook = (*failureCollector)(nil)
+
+// failureFields are the log fields a failure notification may include. Others may contain secrets.
+var failureFields = map[string]struct{}{"exe": {}, "args": {}, "error": {}, "stderr": {}}
+
+// failureEntry is an error logged during a build.
+type failureEntry struct {
+	phase   string
+	message string
+	exe     string
+	fields  []string
+}
+
+// failureNotice is the last failure of a profile notified about.
+type failureNotice struct {
+	fingerprint string
+	at          time.Time
+}
+
+func (*failureCollector) Levels() []log.Level {
+	return []log.Level{log.PanicLevel, log.FatalLevel, log.ErrorLevel}
+}
+
+func (fc *failureCollector) Fire(entry *log.Entry) error {
+	fc.Lock()
+	defer fc.Unlock()
+
+	if fc.active {
+		fields := make([]string, 0, len(failureFields))
+		for name, value := range entry.Data {
+			if _, ok := failureFields[name]; !ok {
+				continue
+			}
+
+			if args, ok := value.([]string); ok && name == "args" {
+				value = redactArgs(args)
+			}
+
+			text := strings.TrimSpace(fieldText(value))
+			if len(text) > maxFailureField {
+				text = text[:maxFailureField] + "..."
+			}
+
+			fields = append(fields, name+": "+text)
+		}
+
+		exe, _ := entry.Data["exe"].(string)
+
+		sort.Strings(fields)
+		fc.entries = append(fc.entries, failureEntry{fc.phase, entry.Message, exe, fields})
+	}
+
+	return nil
+}
+
+// redactArgs hides the values of -c options (e.g. HTTP headers with tokens) and credentials in URLs.
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+
+	for i, arg := range args {
+		switch {
+		case i > 0 && args[i-1] == "-c":
+			if eq := strings.IndexByte(arg, '='); eq >= 0 {
+				arg = arg[:eq+1] + "***"
+			}
+		case strings.Contains(arg, "://"):
+			if parsed, errPU := url.Parse(arg); errPU == nil && parsed.User != nil {
+				parsed.User = nil
+				arg = parsed.String()
+			}
+		}
+
+		redacted[i] = arg
+	}
+
+	return redacted
+}
+
+// start begins collecting errors.
+func (fc *failureCollector) start() {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.active = true
+	fc.phase = ""
+	fc.entries = nil
+}
+
+// enter tells the build phase the errors logged from now on belong to.
+func (fc *failureCollector) enter(phase string) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.phase = phase
+}
+
+// stop ends collecting errors and returns them and the last phase entered.
+func (fc *failureCollector) stop() (phase string, entries []failureEntry) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.active = false
+	return fc.phase, fc.entries
+}
+
+// due tells whether to notify about the failure of profile identified by fingerprint.
+// The same failure is notified about again only after repeat.
+func (fc *failureCollector) due(profile, fingerprint string, repeat time.Duration) bool {
+	fc.Lock()
+	defer fc.Unlock()
+
+	last, ok := fc.notified[profile]
+	return !ok || last.fingerprint != fingerprint || time.Since(last.at) >= repeat
+}
+
+// notifiedAbout remembers that the failure of profile identified by fingerprint has been notified about.
+func (fc *failureCollector) notifiedAbout(profile, fingerprint string) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	fc.notified[profile] = failureNotice{fingerprint, time.Now()}
+}
+
+// recovered forgets the last failure of profile, so that the next one is notified about immediately.
+func (fc *failureCollector) recovered(profile string) {
+	fc.Lock()
+	defer fc.Unlock()
+
+	delete(fc.notified, profile)
+}
+
+// notifyFailure tells that building profile failed in phase due to the errors logged.
+func notifyFailure(config *notifyConfig, profile, phase string, entries []failureEntry) {
+	var in bytes.Buffer
+
+	fmt.Fprintf(&in, "dockerweb2 failed to build and deploy the profile %s in the phase %s.", profile, phase)
+
+	if len(entries) > 0 {
+		in.Write([]byte(" These errors occurred:\n\n"))
+
+		for _, entry := range entries {
+			fmt.Fprintf(&in, "* %s (phase: %s)\n", entry.message, entry.phase)
+
+			for _, field := range entry.fields {
+				fmt.Fprintf(&in, "  %s\n", strings.Replace(field, "\n", "\n    ", -1))
+			}
+		}
+	} else {
+		in.Write([]byte(" See the logs for details.\n"))
+	}
+
+	repeat := defaultFailureRepeat
+	if config.FailureRepeat != "" {
+		repeat, _ = time.ParseDuration(config.FailureRepeat)
+	}
+
+	// The other fields may differ from run to run, e.g. by temporary paths.
+	fingerprint := phase
+	for _, entry := range entries {
+		fingerprint += "\n" + entry.phase + ": " + entry.message + " (" + entry.exe + ")"
+	}
+
+	if !failures.due(profile, fingerprint, repeat) {
+		log.WithFields(log.Fields{"profile": profile, "phase": phase}).Debug(
+			"Not notifying about the same failure again yet",
+		)
+		return
+	}
+
+	if sendNotification(config, "dockerweb2 failed to build "+profile, in.String()) {
+		failures.notifiedAbout(profile, fingerprint)
+	}
+}
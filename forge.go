@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/google/go-github/v28/github"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	forgeGitHub = "github"
+	forgeGitLab = "gitlab"
+	forgeGitea  = "gitea"
+	forgeStatic = "static"
+)
+
+var forgeKinds = map[string]struct{}{forgeGitHub: {}, forgeGitLab: {}, forgeGitea: {}, forgeStatic: {}}
+
+// forge lists the repositories of an owner and tells where to clone them from.
+type forge interface {
+	listRepos(owner string) (repos []forgeRepo, ok bool)
+	cloneURL(owner, name string) string
+	webURL(owner, name string) string
+
+	// archive returns the URL of a .tar.gz of commit and the directory inside it (if supported).
+	archive(owner, name, commit string) (url, dir string)
+
+	// compareURL returns the URL of the changes between two commits (if supported).
+	compareURL(owner, name, from, to string) string
+
+	// releaseURL returns the URL of the release notes of tag (if supported).
+	releaseURL(owner, name, tag string) string
+}
+
+// forgeRepo is a repository as listed by a forge.
+type forgeRepo struct {
+	name     string
+	archived bool
+	fork     bool
+}
+
+func newForge(mod *modConfig, gh *github.Client) forge {
+	switch mod.Forge {
+	case "", forgeGitHub:
+		if mod.Token == "" && mod.TokenFile == "" {
+			return githubForge{gh}
+		}
+
+		token, ok := readToken(mod.Token, mod.TokenFile)
+		if !ok {
+			return nil
+		}
+
+		return githubForge{newGitHubClient(token)}
+	case forgeGitLab, forgeGitea:
+		token, ok := readToken(mod.Token, mod.TokenFile)
+		if !ok {
+			return nil
+		}
+
+		base := strings.TrimSuffix(mod.URL, "/")
+		if mod.Forge == forgeGitLab {
+			return gitlabForge{base, token}
+		}
+
+		return giteaForge{base, token}
+	case forgeStatic:
+		urls := make(map[string]string, len(mod.List))
+		for _, remote := range mod.List {
+			urls[staticRepoName(remote)] = remote
+		}
+
+		return &staticForge{urls}
+	}
+
+	return nil
+}
+
+// newFrameworkForge returns the forge the Icinga Web 2 repository is on.
+// It's only used to locate the repository, not to list any.
+func newFrameworkForge(config *githubConfig) forge {
+	base := strings.TrimSuffix(config.FrameworkURL, "/")
+
+	switch config.FrameworkForge {
+	case forgeGitLab:
+		return gitlabForge{base, ""}
+	case forgeGitea:
+		return giteaForge{base, ""}
+	case forgeStatic:
+		return &staticForge{map[string]string{newRepoOrigin(nil, config.Framework).name: config.FrameworkURL}}
+	}
+
+	return githubForge{}
+}
+
+func newGitHubClient(token string) *github.Client {
+	if token == "" {
+		log.Warn("Using the GitHub API anonymously, the rate limit is quite low")
+		return github.NewClient(nil)
+	}
+
+	return github.NewClient(&http.Client{Transport: tokenTransport{"token " + token, http.DefaultTransport}})
+}
+
+type githubForge struct {
+	client *github.Client
+}
+
+var _ forge = githubForge{}
+
+func (gf githubForge) listRepos(owner string) ([]forgeRepo, bool) {
+	var names []forgeRepo
+	var opts = github.RepositoryListOptions{
+		Visibility:  "public",
+		ListOptions: github.ListOptions{PerPage: 100, Page: 1},
+	}
+
+	for {
+		repos, resp, errLR := gf.client.Repositories.List(background, owner, &opts)
+		if errLR != nil {
+			switch err := errLR.(type) {
+			case *github.RateLimitError:
+				waitForRateLimit(owner, err.Rate.Reset.Time)
+				continue
+			case *github.AbuseRateLimitError:
+				if err.RetryAfter != nil {
+					waitForRateLimit(owner, time.Now().Add(*err.RetryAfter))
+					continue
+				}
+			}
+
+			log.WithFields(log.Fields{
+				"user": owner, "error": jsonableError{errLR},
+			}).Error("Couldn't fetch repos of GitHub user")
+
+			return nil, false
+		}
+
+		log.WithFields(log.Fields{
+			"user": owner, "remaining": resp.Rate.Remaining, "limit": resp.Rate.Limit,
+		}).Trace("Got GitHub API rate limit")
+
+		for _, repo := range repos {
+			names = append(names, forgeRepo{*repo.Name, repo.GetArchived(), repo.GetFork()})
+		}
+
+		if len(repos) < opts.PerPage {
+			break
+		}
+
+		if resp.Rate.Remaining < 1 {
+			waitForRateLimit(owner, resp.Rate.Reset.Time)
+		}
+
+		opts.Page++
+	}
+
+	return names, true
+}
+
+func (githubForge) cloneURL(owner, name string) string {
+	return githubPrefix + owner + "/" + name + githubSuffix
+}
+
+func (githubForge) webURL(owner, name string) string {
+	return githubPrefix + owner + "/" + name
+}
+
+func (gf githubForge) compareURL(owner, name, from, to string) string {
+	return fmt.Sprintf("%s/compare/%s...%s", gf.webURL(owner, name), from, to)
+}
+
+func (gf githubForge) releaseURL(owner, name, tag string) string {
+	return fmt.Sprintf("%s/releases/tag/%s", gf.webURL(owner, name), url.PathEscape(tag))
+}
+
+func (gf githubForge) archive(owner, name, commit string) (string, string) {
+	return fmt.Sprintf("%s/archive/%s.tar.gz", gf.webURL(owner, name), commit), name + "-" + commit
+}
+
+type gitlabForge struct {
+	base, token string
+}
+
+var _ forge = gitlabForge{}
+
+func (gf gitlabForge) listRepos(owner string) ([]forgeRepo, bool) {
+	var names []forgeRepo
+	id := url.PathEscape(owner)
+
+	for _, kind := range [2]string{"groups", "users"} {
+		for page := 1; ; page++ {
+			var repos []struct {
+				Path              string           `json:"path"`
+				Archived          bool             `json:"archived"`
+				ForkedFromProject *json.RawMessage `json:"forked_from_project"`
+			}
+
+			found, ok := getJSON(
+				fmt.Sprintf("%s/api/v4/%s/%s/projects?visibility=public&per_page=100&page=%d", gf.base, kind, id, page),
+				"PRIVATE-TOKEN", gf.token, &repos,
+			)
+			if !ok {
+				return nil, false
+			}
+
+			if !found {
+				break
+			}
+
+			for _, repo := range repos {
+				names = append(names, forgeRepo{repo.Path, repo.Archived, repo.ForkedFromProject != nil})
+			}
+
+			if len(repos) < 100 {
+				return names, true
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{"forge": gf.base, "user": owner}).Error("No such GitLab group or user")
+	return nil, false
+}
+
+func (gf gitlabForge) cloneURL(owner, name string) string {
+	return gf.webURL(owner, name) + ".git"
+}
+
+func (gf gitlabForge) webURL(owner, name string) string {
+	return gf.base + "/" + owner + "/" + name
+}
+
+func (gf gitlabForge) compareURL(owner, name, from, to string) string {
+	return fmt.Sprintf("%s/-/compare/%s...%s", gf.webURL(owner, name), from, to)
+}
+
+func (gf gitlabForge) releaseURL(owner, name, tag string) string {
+	return fmt.Sprintf("%s/-/releases/%s", gf.webURL(owner, name), url.PathEscape(tag))
+}
+
+func (gf gitlabForge) archive(owner, name, commit string) (string, string) {
+	return fmt.Sprintf("%s/-/archive/%s/%s-%s.tar.gz", gf.webURL(owner, name), commit, name, commit), name + "-" + commit
+}
+
+type giteaForge struct {
+	base, token string
+}
+
+var _ forge = giteaForge{}
+
+func (gf giteaForge) listRepos(owner string) ([]forgeRepo, bool) {
+	var names []forgeRepo
+	var token string
+	id := url.PathEscape(owner)
+
+	if gf.token != "" {
+		token = "token " + gf.token
+	}
+
+	for _, kind := range [2]string{"orgs", "users"} {
+		for page := 1; ; page++ {
+			var repos []struct {
+				Name     string `json:"name"`
+				Archived bool   `json:"archived"`
+				Fork     bool   `json:"fork"`
+			}
+
+			found, ok := getJSON(
+				fmt.Sprintf("%s/api/v1/%s/%s/repos?limit=50&page=%d", gf.base, kind, id, page),
+				"Authorization", token, &repos,
+			)
+			if !ok {
+				return nil, false
+			}
+
+			if !found {
+				break
+			}
+
+			for _, repo := range repos {
+				names = append(names, forgeRepo{repo.Name, repo.Archived, repo.Fork})
+			}
+
+			if len(repos) < 50 {
+				return names, true
+			}
+		}
+	}
+
+	log.WithFields(log.Fields{"forge": gf.base, "user": owner}).Error("No such Gitea organization or user")
+	return nil, false
+}
+
+func (gf giteaForge) cloneURL(owner, name string) string {
+	return gf.webURL(owner, name) + ".git"
+}
+
+func (gf giteaForge) webURL(owner, name string) string {
+	return gf.base + "/" + owner + "/" + name
+}
+
+func (gf giteaForge) compareURL(owner, name, from, to string) string {
+	return fmt.Sprintf("%s/compare/%s...%s", gf.webURL(owner, name), from, to)
+}
+
+func (gf giteaForge) releaseURL(owner, name, tag string) string {
+	return fmt.Sprintf("%s/releases/tag/%s", gf.webURL(owner, name), url.PathEscape(tag))
+}
+
+func (gf giteaForge) archive(owner, name, commit string) (string, string) {
+	return fmt.Sprintf("%s/archive/%s.tar.gz", gf.webURL(owner, name), commit), name
+}
+
+// staticForge serves a fixed list of Git repositories.
+// It's used as pointer to keep forges comparable.
+type staticForge struct {
+	urls map[string]string
+}
+
+var _ forge = (*staticForge)(nil)
+
+func (sf *staticForge) listRepos(string) ([]forgeRepo, bool) {
+	names := make([]forgeRepo, 0, len(sf.urls))
+	for name := range sf.urls {
+		names = append(names, forgeRepo{name: name})
+	}
+
+	return names, true
+}
+
+func (sf *staticForge) cloneURL(_, name string) string {
+	return sf.urls[name]
+}
+
+func (sf *staticForge) webURL(_, name string) string {
+	return sf.urls[name]
+}
+
+func (*staticForge) archive(_, _, _ string) (string, string) {
+	return "", ""
+}
+
+func (*staticForge) compareURL(_, _, _, _ string) string {
+	return ""
+}
+
+func (*staticForge) releaseURL(_, _, _ string) string {
+	return ""
+}
+
+func staticRepoName(remote string) string {
+	return strings.TrimSuffix(path.Base(strings.TrimRight(remote, "/")), ".git")
+}
+
+func waitForRateLimit(user string, reset time.Time) {
+	log.WithFields(log.Fields{"user": user, "until": reset}).Warn("API rate limit exceeded, waiting for reset")
+	time.Sleep(time.Until(reset) + time.Second)
+}
+
+// getJSON GETs uri and decodes the response into v. It reports a 404 as not found.
+func getJSON(uri, authHeader, auth string, v interface{}) (found, ok bool) {
+	return requestJSON("GET", uri, authHeader, auth, nil, v)
+}
+
+// requestJSON sends in (if any) JSON-encoded to uri and decodes the response into out (if any).
+// It reports a 404 as not found.
+func requestJSON(method, uri, authHeader, auth string, in, out interface{}) (found, ok bool) {
+	var reqBody []byte
+	if in != nil {
+		var errJM error
+		if reqBody, errJM = json.Marshal(in); errJM != nil {
+			log.WithFields(log.Fields{"url": uri, "error": jsonableError{errJM}}).Error("Couldn't render API request")
+			return
+		}
+	}
+
+	for {
+		log.WithFields(log.Fields{"method": method, "url": uri}).Debug("Requesting API")
+
+		req, errNR := http.NewRequest(method, uri, bytes.NewReader(reqBody))
+		if errNR != nil {
+			log.WithFields(log.Fields{"url": uri, "error": jsonableError{errNR}}).Error("Bad API URL")
+			return
+		}
+
+		req.Header.Set("Accept", "application/json")
+		if in != nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+
+		if auth != "" {
+			req.Header.Set(authHeader, auth)
+		}
+
+		resp, errDo := http.DefaultClient.Do(req)
+		if errDo != nil {
+			log.WithFields(log.Fields{"url": uri, "error": jsonableError{errDo}}).Error("API request failed")
+			return
+		}
+
+		body, errRA := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if errRA != nil {
+			log.WithFields(log.Fields{"url": uri, "error": jsonableError{errRA}}).Error("API request failed")
+			return
+		}
+
+		switch {
+		case resp.StatusCode == http.StatusNotFound:
+			return false, true
+		case resp.StatusCode == http.StatusTooManyRequests:
+			retry, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			if retry < 1 {
+				retry = 60
+			}
+
+			waitForRateLimit(uri, time.Now().Add(time.Duration(retry)*time.Second))
+			continue
+		case resp.StatusCode < 200 || resp.StatusCode > 299:
+			log.WithFields(log.Fields{
+				"url": uri, "status": resp.Status, "body": string(body),
+			}).Error("API request failed")
+			return
+		}
+
+		if out != nil {
+			if errJU := json.Unmarshal(body, out); errJU != nil {
+				log.WithFields(log.Fields{"url": uri, "error": jsonableError{errJU}}).Error("Couldn't parse API response")
+				return
+			}
+		}
+
+		return true, true
+	}
+}
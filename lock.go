@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"path"
+)
+
+// lockedRepo is a Git repository as recorded in the lockfile.
+type lockedRepo struct {
+	Owner      string `json:"owner"`
+	Repo       string `json:"repo"`
+	URL        string `json:"url"`
+	Remote     string `json:"remote"`
+	Tag        string `json:"tag"`
+	Commit     string `json:"commit"`
+	Tree       string `json:"tree,omitempty"`
+	Pattern    string `json:"pattern,omitempty"`
+	RequiredBy string `json:"required_by,omitempty"`
+
+	forge forge
+}
+
+// lockfile records exactly what a build chose, for machines.
+type lockfile struct {
+	Framework lockedRepo            `json:"framework"`
+	Modules   map[string]lockedRepo `json:"modules"`
+}
+
+func newLockfile(res *buildResult) (*lockfile, bool) {
+	framework, ok := newLockedRepo(&res.framework)
+	if !ok {
+		return nil, false
+	}
+
+	lock := &lockfile{framework, make(map[string]lockedRepo, len(res.mods))}
+
+	for _, name := range sortedModNames(res.mods) {
+		repo := res.mods[name]
+		if lock.Modules[name], ok = newLockedRepo(&repo); !ok {
+			return nil, false
+		}
+	}
+
+	return lock, true
+}
+
+func newLockedRepo(repo *gitRepo) (lockedRepo, bool) {
+	locked := lockedRepo{
+		Owner:      repo.owner,
+		Repo:       repo.name,
+		URL:        repo.forge.webURL(repo.owner, repo.name),
+		Remote:     repo.remote,
+		Tag:        repo.ref,
+		Commit:     repo.commit,
+		Pattern:    repo.pattern,
+		RequiredBy: repo.requiredBy,
+		forge:      repo.forge,
+	}
+
+	if repo.commit != "HEAD" {
+		tree, ok := runCmd(
+			"git", "-C", path.Join(gitMirrorPath, mirrorDir(repo.remote)), "rev-parse", repo.commit+"^{tree}",
+		)
+		if !ok {
+			return lockedRepo{}, false
+		}
+
+		locked.Tree = string(bytes.TrimSpace(tree))
+	}
+
+	return locked, true
+}
+
+func (l *lockfile) marshal() ([]byte, bool) {
+	raw, errJM := json.MarshalIndent(l, "", "\t")
+	if errJM != nil {
+		log.WithFields(log.Fields{"error": jsonableError{errJM}}).Error("Couldn't render lockfile")
+		return nil, false
+	}
+
+	return append(raw, '\n'), true
+}
@@ -6,167 +6,150 @@ import (
 	"github.com/fsnotify/fsnotify"
 	"github.com/robfig/cron/v3"
 	log "github.com/sirupsen/logrus"
-	"gopkg.in/yaml.v2"
-	"io/ioutil"
+	"os"
 	"path"
+	"reflect"
 	"regexp"
-	"strings"
 	"time"
 )
 
+// profile is a validated build profile with its own schedule.
+type profile struct {
+	name      string
+	config    *profileConfig
+	deployDir string
+	schedule  cron.Schedule
+	nextBuild time.Time
+}
+
 func main() {
 	initLogging()
 	go wait4term()
 
+	if len(os.Args) > 1 {
+		// stdout is for the subcommands' results.
+		log.SetOutput(os.Stderr)
+	}
+
 	log.WithFields(log.Fields{"projects": GithubcomAl2klimovGo_gen_source_repos}).Debug(
 		"For the terms of use, the source code and the authors see the projects this program is assembled from",
 	)
 
+	if len(os.Args) > 1 {
+		exit(runSubcommand(os.Args[1], os.Args[2:]))
+	}
+
+	if !lockDataDir() {
+		exit(1)
+	}
+
 	watcher := mkWatcher()
+	var api *apiServer
+	var secretFiles map[string]struct{}
+
+	// The last valid config stays in effect until a valid one replaces it.
+	var profiles []*profile
+	var mirrors *mirrorUsage
+	var timer *time.Timer = nil
+	var timerCh <-chan time.Time = nil
+	patterns := map[string]*regexp.Regexp{}
+
+	// lastRejected are the problems of the config rejected last, not to notify about them on every write.
+	var lastRejected []string
 
 LoadConfig:
 	for {
-		var config *configuration
-		var ok bool
-		var level log.Level
-		var schedule cron.Schedule
-		var nextBuild time.Time
-		var timer *time.Timer = nil
-		var timerCh <-chan time.Time = nil
-		patterns := map[string]*regexp.Regexp{}
-
-		{
-			if config, ok = loadConfig(); ok {
-				if config.Log.Level == "" {
-					config.Log.Level = "info"
-				}
+		var newProfiles []*profile
+		newPatterns := map[string]*regexp.Regexp{}
 
-				{
-					var errPL error
-					if level, errPL = log.ParseLevel(config.Log.Level); errPL != nil {
-						log.WithFields(log.Fields{
-							"bad_level": config.Log.Level, "did_you_mean": jsonableBadLogLevelAlt{config.Log.Level},
-						}).Error("Bad log level")
+		config, level, rejected := readConfig(newPatterns, &newProfiles)
+		if config != nil {
+			secretFiles = watchSecrets(watcher, secretFiles, config.secretFiles)
+		}
 
-						ok = false
-					}
-				}
+		if len(rejected) < 1 {
+			lastRejected = nil
 
-				if strings.TrimSpace(config.Build.Every) == "" {
-					log.Error("Build schedule missing")
-					ok = false
-				} else {
-					var errCP error
-					if schedule, errCP = cronParser.Parse(config.Build.Every); errCP != nil {
-						log.WithFields(log.Fields{
-							"bad_schedule": config.Build.Every, "error": jsonableError{errCP},
-						}).Error("Bad build schedule")
-						ok = false
-					}
-				}
+			log.WithFields(log.Fields{"old": log.GetLevel(), "new": level}).Trace("Changing log level")
+			log.SetLevel(level)
 
-				if strings.TrimSpace(config.GitHub.Framework) == "" {
-					log.Error("Icinga Web 2 repository missing")
-					ok = false
-				}
+			if timer != nil {
+				timer.Stop()
+			}
 
-				for i, mod := range config.GitHub.Mods {
-					if strings.TrimSpace(mod.User) == "" {
-						log.WithFields(log.Fields{"mods_idx": i}).Error("Organization missing")
-						ok = false
-					}
+			profiles, patterns = newProfiles, newPatterns
+			api = serveAPI(api, config.HTTP.Listen)
+			apiAuth.configure(config.HTTP.Token, config.HTTP.TokenFile)
+			hooks.configure(&config.HTTP.Webhook, profiles, patterns)
+			mirrors = newMirrorUsage(len(profiles))
+			status.reset(profiles)
+			now := time.Now()
+
+			for _, p := range profiles {
+				scheduleBuild(p, now)
+			}
 
-					if len(mod.Repos) == 0 {
-						log.WithFields(log.Fields{"mods_idx": i}).Error("Repository patterns missing")
-						ok = false
-					} else {
-						for _, repo := range mod.Repos {
-							if _, ok := patterns[repo]; !ok {
-								if rgx, errRC := regexp.Compile(repo); errRC == nil {
-									if rgx.NumSubexp() == 1 {
-										patterns[repo] = rgx
-									} else {
-										log.WithFields(log.Fields{
-											"bad_pattern": repo, "subpatterns": rgx.NumSubexp(),
-										}).Error("Repository pattern with not exactly one subpattern")
-
-										patterns[repo] = nil
-										ok = false
-									}
-								} else {
-									log.WithFields(log.Fields{
-										"bad_pattern": repo, "error": jsonableError{errRC},
-									}).Error("Bad repository pattern")
-
-									patterns[repo] = nil
-									ok = false
-								}
-							}
+			timer, timerCh = prepareSleep(nextBuild(profiles).Sub(now))
+		} else if profiles != nil {
+			log.WithFields(log.Fields{"path": configPath}).Warn("Rejected invalid config, keeping the previous one")
+
+			if reflect.DeepEqual(rejected, lastRejected) {
+				log.WithFields(log.Fields{"path": configPath}).Debug("Not notifying about the same problems again")
+			} else {
+				lastRejected = rejected
+				var notified []*notifyConfig
+
+			Notify:
+				for _, p := range profiles {
+					for _, done := range notified {
+						if reflect.DeepEqual(done, &p.config.Notify) {
+							continue Notify
 						}
 					}
-				}
-
-				if strings.TrimSpace(config.Deploy.Remote) == "" {
-					log.Error("Deploy repository missing")
-					ok = false
-				}
-
-				if strings.TrimSpace(config.Deploy.Script) == "" {
-					log.Error("Deploy path missing")
-					ok = false
-				}
 
-				if strings.TrimSpace(config.Deploy.Commit) == "" {
-					log.Error("Deploy commit message missing")
-					ok = false
+					notified = append(notified, &p.config.Notify)
+					notifyConfigRejected(&p.config.Notify, rejected)
 				}
 			}
 		}
 
-		if ok {
-			log.WithFields(log.Fields{"old": log.GetLevel(), "new": level}).Trace("Changing log level")
-			log.SetLevel(level)
-
-			now := time.Now()
-			nextBuild = schedule.Next(now)
-
-			log.WithFields(log.Fields{"next_build": nextBuild}).Info("Scheduling next build")
-			timer, timerCh = prepareSleep(nextBuild.Sub(now))
-		}
-
 		for {
 			select {
 			case now := <-timerCh:
-				if now.Before(nextBuild) {
-					timer, timerCh = prepareSleep(nextBuild.Sub(now))
-				} else {
-					rmDir(tempDir, log.InfoLevel)
-					if mkDir(tempDir) {
-						log.Info("Building")
-						if script, unknown := build(&config.GitHub, patterns); script != nil {
-							log.Info("Deploying")
-							deploy(&config.Deploy, script)
-
-							notify(config.Notify, unknown)
-						}
+				for _, p := range profiles {
+					if !now.Before(p.nextBuild) {
+						buildProfile(p, triggerSchedule, patterns, mirrors)
+						scheduleBuild(p, time.Now())
 					}
+				}
 
-					nextBuild = schedule.Next(time.Now())
-
-					log.WithFields(log.Fields{"next_build": nextBuild}).Info("Scheduling next build")
-					timer, timerCh = prepareSleep(nextBuild.Sub(now))
+				timer, timerCh = prepareSleep(time.Until(nextBuild(profiles)))
+			case <-hooks.ready:
+				for _, name := range hooks.drain() {
+					for _, p := range profiles {
+						if p.name == name {
+							buildProfile(p, triggerWebhook, patterns, mirrors)
+						}
+					}
+				}
+			case trigger := <-buildTriggers:
+				for _, p := range profiles {
+					if trigger.profile == "" || trigger.profile == p.name {
+						buildProfile(p, trigger.by, patterns, mirrors)
+					}
 				}
 			case event := <-watcher.Events:
 				log.WithFields(log.Fields{
 					"parent": watchPath, "child": event.Name, "op": jsonableStringer{event.Op},
 				}).Trace("Got FS event")
 
-				if event.Op&^fsnotify.Chmod != 0 && path.Clean(event.Name) == configPath {
-					if timer != nil {
-						timer.Stop()
+				if event.Op&^fsnotify.Chmod != 0 {
+					if name := path.Clean(event.Name); name == configPath {
+						continue LoadConfig
+					} else if _, ok := secretFiles[name]; ok {
+						log.WithFields(log.Fields{"file": name}).Info("Interpolated file changed")
+						continue LoadConfig
 					}
-
-					continue LoadConfig
 				}
 			case errWa := <-watcher.Errors:
 				log.WithFields(log.Fields{"error": jsonableError{errWa}}).Fatal("FS watcher error")
@@ -175,6 +158,85 @@ LoadConfig:
 	}
 }
 
+func scheduleBuild(p *profile, now time.Time) {
+	p.nextBuild = p.schedule.Next(now)
+	log.WithFields(log.Fields{"profile": p.name, "next_build": p.nextBuild}).Info("Scheduling next build")
+
+	status.scheduled(p.name, p.nextBuild)
+}
+
+// nextBuild returns the earliest of the profiles' next builds.
+func nextBuild(profiles []*profile) time.Time {
+	next := profiles[0].nextBuild
+	for _, p := range profiles[1:] {
+		if p.nextBuild.Before(next) {
+			next = p.nextBuild
+		}
+	}
+
+	return next
+}
+
+func buildProfile(p *profile, trigger string, patterns map[string]*regexp.Regexp, mirrors *mirrorUsage) bool {
+	bs := &buildStatus{Trigger: trigger, Started: time.Now()}
+	var selected *selectedVersions
+
+	config := p.config
+	failures.start()
+
+	defer func() {
+		bs.Finished = time.Now()
+		status.built(p.name, bs, selected)
+
+		if phase, entries := failures.stop(); bs.OK {
+			failures.recovered(p.name)
+		} else {
+			notifyFailure(&config.Notify, p.name, phase, entries)
+		}
+	}()
+
+	failures.enter(phasePrepare)
+	rmDir(tempDir, log.InfoLevel)
+	if !mkDir(tempDir) {
+		metrics.build(p.name, false)
+		return false
+	}
+
+	log.WithFields(log.Fields{"profile": p.name, "trigger": trigger}).Info("Building")
+	if res := build(p.name, &config.GitHub, patterns, config.Deploy.Fetch == fetchModeTarball, mirrors); res != nil {
+		bs.Problems = res.problems
+		bs.Unknown = len(res.unknown)
+		metrics.unknown(p.name, len(res.unknown))
+
+		failures.enter(phaseRender)
+
+		if files, lock := deployFiles(&config.Deploy, res); files != nil {
+			metrics.build(p.name, true)
+			log.WithFields(log.Fields{"profile": p.name}).Info("Deploying")
+
+			failures.enter(phaseDeploy)
+			start := time.Now()
+			bs.OK = deploy(&config.Deploy, p.deployDir, files, lock, lastDeployed(p.name))
+
+			metrics.phase(p.name, phaseDeploy, start)
+			metrics.deploy(p.name, bs.OK)
+
+			if bs.OK {
+				selected = newSelectedVersions(res)
+				notifyReleases(p.name, &config.Notify, lock)
+			}
+		} else {
+			metrics.build(p.name, false)
+		}
+
+		notify(p.name, config.Notify, res.unknown, res.problems)
+	} else {
+		metrics.build(p.name, false)
+	}
+
+	return bs.OK
+}
+
 func mkWatcher() *fsnotify.Watcher {
 	log.Trace("Setting up FS watcher")
 
@@ -192,23 +254,41 @@ func mkWatcher() *fsnotify.Watcher {
 	return watcher
 }
 
-func loadConfig() (config *configuration, ok bool) {
-	log.WithFields(log.Fields{"path": configPath}).Info("Loading config")
+// watchSecrets makes watcher watch the directories of the files config.yml interpolates now instead of the old ones.
+func watchSecrets(watcher *fsnotify.Watcher, old, now map[string]struct{}) map[string]struct{} {
+	dirs := func(files map[string]struct{}) map[string]struct{} {
+		dirs := map[string]struct{}{}
+		for file := range files {
+			if dir := path.Dir(file); dir != path.Clean(watchPath) {
+				dirs[dir] = struct{}{}
+			}
+		}
+
+		return dirs
+	}
+
+	oldDirs, newDirs := dirs(old), dirs(now)
 
-	raw, errRF := ioutil.ReadFile(configPath)
-	if errRF != nil {
-		log.WithFields(log.Fields{"path": configPath, "error": jsonableError{errRF}}).Error("Couldn't read config")
-		return
+	for dir := range oldDirs {
+		if _, ok := newDirs[dir]; !ok {
+			log.WithFields(log.Fields{"path": dir}).Debug("Unwatching FS")
+
+			if errWR := watcher.Remove(dir); errWR != nil {
+				log.WithFields(log.Fields{"path": dir, "error": jsonableError{errWR}}).Warn("Couldn't unwatch FS")
+			}
+		}
 	}
 
-	config = &configuration{}
-	if errYU := yaml.Unmarshal(raw, config); errYU != nil {
-		log.WithFields(log.Fields{"path": configPath, "error": jsonableError{errYU}}).Error("Couldn't parse config")
-		return
+	// Re-adding is harmless and retries what failed previously.
+	for dir := range newDirs {
+		log.WithFields(log.Fields{"path": dir}).Debug("Watching FS")
+
+		if errWA := watcher.Add(dir); errWA != nil {
+			log.WithFields(log.Fields{"path": dir, "error": jsonableError{errWA}}).Error("Couldn't watch FS")
+		}
 	}
 
-	ok = true
-	return
+	return now
 }
 
 func prepareSleep(duration time.Duration) (*time.Timer, <-chan time.Time) {
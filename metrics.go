@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	phasePrepare       = "prepare"
+	phaseFetchMods     = "fetchMods"
+	phaseUpdateMirrors = "updateMirrors"
+	phaseRender        = "render"
+	phaseDeploy        = "deploy"
+)
+
+// execRunning counts the commands currently holding execSemaphore.
+var execRunning int64
+
+var metrics = &daemonMetrics{
+	builds:        map[profileResult]uint64{},
+	deploys:       map[profileResult]uint64{},
+	phases:        map[profilePhase]*durations{},
+	fetchFailures: map[string]uint64{},
+	unknownRepos:  map[string]int{},
+	lastDeploy:    map[string]time.Time{},
+}
+
+// daemonMetrics are exposed in the Prometheus text format.
+type daemonMetrics struct {
+	sync.Mutex
+
+	builds        map[profileResult]uint64
+	deploys       map[profileResult]uint64
+	phases        map[profilePhase]*durations
+	fetchFailures map[string]uint64
+	unknownRepos  map[string]int
+	lastDeploy    map[string]time.Time
+}
+
+type profileResult struct {
+	profile string
+	ok      bool
+}
+
+type profilePhase struct {
+	profile, phase string
+}
+
+type durations struct {
+	count uint64
+	sum   time.Duration
+}
+
+func (dm *daemonMetrics) build(profile string, ok bool) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	dm.builds[profileResult{profile, ok}]++
+}
+
+func (dm *daemonMetrics) deploy(profile string, ok bool) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	dm.deploys[profileResult{profile, ok}]++
+
+	if ok {
+		dm.lastDeploy[profile] = time.Now()
+	}
+}
+
+// phase records the duration of a build phase which started at since.
+func (dm *daemonMetrics) phase(profile, phase string, since time.Time) {
+	took := time.Since(since)
+
+	dm.Lock()
+	defer dm.Unlock()
+
+	key := profilePhase{profile, phase}
+	d, ok := dm.phases[key]
+	if !ok {
+		d = &durations{}
+		dm.phases[key] = d
+	}
+
+	d.count++
+	d.sum += took
+}
+
+func (dm *daemonMetrics) fetchFailed(remote string) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	dm.fetchFailures[remote]++
+}
+
+func (dm *daemonMetrics) unknown(profile string, repos int) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	dm.unknownRepos[profile] = repos
+}
+
+func (dm *daemonMetrics) writeTo(w io.Writer) {
+	dm.Lock()
+	defer dm.Unlock()
+
+	var lines []string
+
+	writeMetric(w, "dockerweb2_builds_total", "counter", "Builds by profile and result.")
+	for key, count := range dm.builds {
+		lines = append(lines, fmt.Sprintf(
+			"dockerweb2_builds_total{profile=%s,result=%s} %d", quoteLabel(key.profile), resultLabel(key.ok), count,
+		))
+	}
+	writeLines(w, lines)
+
+	writeMetric(w, "dockerweb2_deploys_total", "counter", "Deploys by profile and result.")
+	lines = lines[:0]
+	for key, count := range dm.deploys {
+		lines = append(lines, fmt.Sprintf(
+			"dockerweb2_deploys_total{profile=%s,result=%s} %d", quoteLabel(key.profile), resultLabel(key.ok), count,
+		))
+	}
+	writeLines(w, lines)
+
+	writeMetric(w, "dockerweb2_phase_duration_seconds", "summary", "Durations of build phases.")
+	lines = lines[:0]
+	for key, d := range dm.phases {
+		labels := fmt.Sprintf("{profile=%s,phase=%s}", quoteLabel(key.profile), quoteLabel(key.phase))
+		lines = append(
+			lines,
+			fmt.Sprintf("dockerweb2_phase_duration_seconds_sum%s %g", labels, d.sum.Seconds()),
+			fmt.Sprintf("dockerweb2_phase_duration_seconds_count%s %d", labels, d.count),
+		)
+	}
+	writeLines(w, lines)
+
+	writeMetric(w, "dockerweb2_fetch_failures_total", "counter", "Failed fetches by repository.")
+	lines = lines[:0]
+	for remote, count := range dm.fetchFailures {
+		lines = append(lines, fmt.Sprintf(
+			"dockerweb2_fetch_failures_total{remote=%s} %d", quoteLabel(remote), count,
+		))
+	}
+	writeLines(w, lines)
+
+	writeMetric(w, "dockerweb2_unknown_repos", "gauge", "Repositories not covered by any pattern.")
+	lines = lines[:0]
+	for profile, repos := range dm.unknownRepos {
+		lines = append(lines, fmt.Sprintf("dockerweb2_unknown_repos{profile=%s} %d", quoteLabel(profile), repos))
+	}
+	writeLines(w, lines)
+
+	writeMetric(
+		w, "dockerweb2_last_successful_deploy_timestamp_seconds", "gauge", "When the last deploy succeeded.",
+	)
+	lines = lines[:0]
+	for profile, at := range dm.lastDeploy {
+		lines = append(lines, fmt.Sprintf(
+			"dockerweb2_last_successful_deploy_timestamp_seconds{profile=%s} %d", quoteLabel(profile), at.Unix(),
+		))
+	}
+	writeLines(w, lines)
+
+	writeMetric(w, "dockerweb2_exec_running", "gauge", "Commands currently running.")
+	fmt.Fprintf(w, "dockerweb2_exec_running %d\n", atomic.LoadInt64(&execRunning))
+
+	writeMetric(w, "dockerweb2_exec_limit", "gauge", "How many commands may run at once.")
+	fmt.Fprintf(w, "dockerweb2_exec_limit %d\n", execLimit)
+}
+
+// writeMetric writes the metadata of a metric.
+func writeMetric(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// writeLines writes the samples of a metric sorted for stable output.
+func writeLines(w io.Writer, lines []string) {
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+}
+
+func resultLabel(ok bool) string {
+	if ok {
+		return `"success"`
+	}
+
+	return `"failure"`
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.writeTo(w)
+}
@@ -9,6 +9,8 @@ import (
 	lev "github.com/schollz/closestmatch/levenshtein"
 	log "github.com/sirupsen/logrus"
 	"golang.org/x/sync/semaphore"
+	"io"
+	"io/ioutil"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -17,6 +19,7 @@ import (
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 )
 
@@ -24,14 +27,18 @@ const watchPath = "./"
 const configPath = "config.yml"
 const gitMirrorPath = "mirrors"
 const deployGitPath = "deploy"
+const profileDeployPath = "deploys"
 const tempDir = "tmp"
+const notifyStatePath = "notified.json"
+const dataLockPath = "dockerweb2.lock"
 const githubPrefix = "https://github.com/"
 const githubSuffix = ".git"
 
 var tempChild = path.Join(tempDir, "*")
 var noInterrupt sync.RWMutex
 var background = context.Background()
-var execSemaphore = semaphore.NewWeighted(int64(runtime.GOMAXPROCS(0)) * 2)
+var execLimit = int64(runtime.GOMAXPROCS(0)) * 2
+var execSemaphore = semaphore.NewWeighted(execLimit)
 var versionTag = regexp.MustCompile(`\Av?(.+?)\z`)
 
 var logLevels = func() *lev.ClosestMatch {
@@ -45,6 +52,51 @@ var logLevels = func() *lev.ClosestMatch {
 
 var cronParser = cron.NewParser(cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow)
 
+const (
+	trackLatestTag        = "latest-tag"
+	trackLatestPrerelease = "latest-prerelease"
+	trackBranch           = "branch"
+	trackCommit           = "commit"
+)
+
+// splitTrack splits a track option like branch:master into its kind and argument.
+func splitTrack(track string) (kind, arg string) {
+	if track == "" {
+		return trackLatestTag, ""
+	}
+
+	if colon := strings.IndexByte(track, ':'); colon >= 0 {
+		return track[:colon], track[colon+1:]
+	}
+
+	return track, ""
+}
+
+// validateTrack records what's wrong with a track option and its combination with a version constraint.
+func validateTrack(track, constraint string, problems configProblems) {
+	switch kind, arg := splitTrack(track); kind {
+	case trackLatestTag, trackLatestPrerelease:
+		if arg == "" {
+			return
+		}
+	case trackBranch, trackCommit:
+		// A leading - would be taken as an option by git.
+		if strings.TrimSpace(arg) == "" || strings.HasPrefix(arg, "-") {
+			break
+		}
+
+		if constraint != "" {
+			problems.add("Version constraint given for a branch or commit", log.Fields{
+				"track": track, "constraint": constraint,
+			})
+		}
+
+		return
+	}
+
+	problems.add("Bad track option", log.Fields{"bad_track": track})
+}
+
 type jsonableError struct {
 	err error
 }
@@ -75,31 +127,115 @@ func (jblla jsonableBadLogLevelAlt) MarshalText() (text []byte, err error) {
 	return []byte(logLevels.Closest(strings.ToLower(jblla.badLogLevel))), nil
 }
 
+// fieldText renders the value of a log field like the log does.
+func fieldText(value interface{}) string {
+	if text, ok := value.(encoding.TextMarshaler); ok {
+		if raw, errMT := text.MarshalText(); errMT == nil {
+			return string(raw)
+		}
+	}
+
+	return fmt.Sprint(value)
+}
+
 type modConfig struct {
-	User  string   `yaml:"user"`
-	Repos []string `yaml:"repos"`
+	Forge     string            `yaml:"forge"`
+	URL       string            `yaml:"url"`
+	Token     string            `yaml:"token"`
+	TokenFile string            `yaml:"token_file"`
+	User      string            `yaml:"user"`
+	List      []string          `yaml:"list"`
+	Repos     []string          `yaml:"repos"`
+	Versions  map[string]string `yaml:"versions"`
+	Track     map[string]string `yaml:"track"`
+
+	Exclude      []string `yaml:"exclude"`
+	Ignore       []string `yaml:"ignore"`
+	SkipArchived bool     `yaml:"skip_archived"`
+	SkipForks    bool     `yaml:"skip_forks"`
 }
 
 type githubConfig struct {
-	Framework string      `yaml:"framework"`
-	Mods      []modConfig `yaml:"mods"`
+	Token            string      `yaml:"token"`
+	TokenFile        string      `yaml:"token_file"`
+	Framework        string      `yaml:"framework"`
+	FrameworkForge   string      `yaml:"framework_forge"`
+	FrameworkURL     string      `yaml:"framework_url"`
+	FrameworkVersion string      `yaml:"framework_version"`
+	FrameworkTrack   string      `yaml:"framework_track"`
+	Mods             []modConfig `yaml:"mods"`
+}
+
+type dockerConfig struct {
+	Dockerfile string   `yaml:"dockerfile"`
+	Base       string   `yaml:"base"`
+	PHP        string   `yaml:"php"`
+	Extensions []string `yaml:"extensions"`
+}
+
+type pullRequestConfig struct {
+	Forge        string `yaml:"forge"`
+	URL          string `yaml:"url"`
+	Token        string `yaml:"token"`
+	TokenFile    string `yaml:"token_file"`
+	Repo         string `yaml:"repo"`
+	Base         string `yaml:"base"`
+	BranchPrefix string `yaml:"branch_prefix"`
 }
 
 type deployConfig struct {
-	Remote string            `yaml:"remote"`
-	Config map[string]string `yaml:"config"`
-	Script string            `yaml:"script"`
-	Commit string            `yaml:"commit"`
+	Remote   string            `yaml:"remote"`
+	Config   map[string]string `yaml:"config"`
+	Script   string            `yaml:"script"`
+	Template string            `yaml:"template"`
+	Fetch    string            `yaml:"fetch"`
+	Lockfile string            `yaml:"lockfile"`
+	Commit   string            `yaml:"commit"`
+	Docker   dockerConfig      `yaml:"docker"`
+
+	PullRequest pullRequestConfig `yaml:"pull_request"`
+}
+
+type webhookConfig struct {
+	Secret     string `yaml:"secret"`
+	SecretFile string `yaml:"secret_file"`
+	Debounce   string `yaml:"debounce"`
+}
+
+type smtpConfig struct {
+	Server       string   `yaml:"server"`
+	Username     string   `yaml:"username"`
+	Password     string   `yaml:"password"`
+	PasswordFile string   `yaml:"password_file"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+}
+
+type slackConfig struct {
+	URL     string `yaml:"url"`
+	Channel string `yaml:"channel"`
+}
+
+type matrixConfig struct {
+	Homeserver string   `yaml:"homeserver"`
+	Token      string   `yaml:"token"`
+	TokenFile  string   `yaml:"token_file"`
+	Rooms      []string `yaml:"rooms"`
 }
 
 type notifyConfig struct {
-	SNail string `yaml:"s_nail"`
+	SNail    string        `yaml:"s_nail"`
+	SMTP     smtpConfig    `yaml:"smtp"`
+	Webhooks []string      `yaml:"webhooks"`
+	Slack    []slackConfig `yaml:"slack"`
+	Matrix   matrixConfig  `yaml:"matrix"`
+
+	Digest        string `yaml:"digest"`
+	FailureRepeat string `yaml:"failure_repeat"`
+	Releases      bool   `yaml:"releases"`
 }
 
-type configuration struct {
-	Log struct {
-		Level string `yaml:"level"`
-	} `yaml:"log"`
+type profileConfig struct {
 	Build struct {
 		Every string `yaml:"every"`
 	} `yaml:"build"`
@@ -108,11 +244,37 @@ type configuration struct {
 	Notify notifyConfig `yaml:"notify"`
 }
 
+type namedProfileConfig struct {
+	Name          string `yaml:"name"`
+	profileConfig `yaml:",inline"`
+}
+
+type configuration struct {
+	Log struct {
+		Level string `yaml:"level"`
+	} `yaml:"log"`
+	HTTP struct {
+		Listen    string        `yaml:"listen"`
+		Token     string        `yaml:"token"`
+		TokenFile string        `yaml:"token_file"`
+		Webhook   webhookConfig `yaml:"webhook"`
+	} `yaml:"http"`
+
+	// profileConfig is the only profile unless Profiles are given.
+	profileConfig `yaml:",inline"`
+
+	Profiles []namedProfileConfig `yaml:"profiles"`
+
+	// secretFiles are the files interpolated via ${file:...}.
+	secretFiles map[string]struct{}
+}
+
 func initLogging() {
 	log.SetFormatter(&log.JSONFormatter{})
 	log.SetOutput(os.Stdout)
 	log.SetLevel(log.TraceLevel)
 	log.StandardLogger().ExitFunc = exit
+	log.AddHook(failures)
 }
 
 func wait4term() {
@@ -133,6 +295,30 @@ func exit(code int) {
 	os.Exit(code)
 }
 
+// dataLock is held as long as the process uses the data dir.
+var dataLock *os.File
+
+// lockDataDir makes sure no other process (e.g. the daemon) builds in the data dir at the same time.
+func lockDataDir() bool {
+	file, errOF := os.OpenFile(dataLockPath, os.O_CREATE|os.O_RDWR, 0600)
+	if errOF != nil {
+		log.WithFields(log.Fields{"path": dataLockPath, "error": jsonableError{errOF}}).Error("Couldn't open lock file")
+		return false
+	}
+
+	if errFl := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); errFl != nil {
+		file.Close()
+
+		log.WithFields(log.Fields{"path": dataLockPath, "error": jsonableError{errFl}}).Error(
+			"Couldn't lock the data dir, is another instance (e.g. the daemon) running?",
+		)
+		return false
+	}
+
+	dataLock = file
+	return true
+}
+
 func mkDir(dir string) bool {
 	log.WithFields(log.Fields{"path": dir}).Debug("Creating dir")
 
@@ -153,31 +339,47 @@ func rmDir(dir string, logLevel log.Level) {
 }
 
 func runCmd(name string, arg ...string) (stdout []byte, ok bool) {
+	var out bytes.Buffer
+	if !runCmdTo(&out, name, arg...) {
+		return nil, false
+	}
+
+	return out.Bytes(), true
+}
+
+// runCmdTo is like runCmd, but streams stdout into out.
+func runCmdTo(out io.Writer, name string, arg ...string) bool {
 	cmd := exec.Command(name, arg...)
-	var out, err bytes.Buffer
+	var err bytes.Buffer
 
-	cmd.Stdout = &out
+	cmd.Stdout = out
 	cmd.Stderr = &err
 
 	noInterrupt.RLock()
 	execSemaphore.Acquire(background, 1)
+	atomic.AddInt64(&execRunning, 1)
 
 	log.WithFields(log.Fields{"exe": name, "args": arg}).Debug("Running command")
 	errRn := cmd.Run()
 
+	atomic.AddInt64(&execRunning, -1)
 	execSemaphore.Release(1)
 	noInterrupt.RUnlock()
 
 	if errRn != nil {
-		log.WithFields(log.Fields{
-			"exe": name, "args": arg, "error": jsonableError{errRn},
-			"stdout": jsonableStringer{&out}, "stderr": jsonableStringer{&err},
-		}).Error("Command failed")
+		fields := log.Fields{
+			"exe": name, "args": arg, "error": jsonableError{errRn}, "stderr": jsonableStringer{&err},
+		}
 
-		return nil, false
+		if str, ok := out.(fmt.Stringer); ok {
+			fields["stdout"] = jsonableStringer{str}
+		}
+
+		log.WithFields(fields).Error("Command failed")
+		return false
 	}
 
-	return out.Bytes(), true
+	return true
 }
 
 func rename(old, new string) bool {
@@ -191,11 +393,34 @@ func rename(old, new string) bool {
 	return true
 }
 
+func readToken(token, tokenFile string) (string, bool) {
+	if tokenFile == "" {
+		return token, true
+	}
+
+	log.WithFields(log.Fields{"file": tokenFile}).Trace("Reading token")
+
+	raw, errRF := ioutil.ReadFile(tokenFile)
+	if errRF != nil {
+		log.WithFields(log.Fields{"file": tokenFile, "error": jsonableError{errRF}}).Error("Couldn't read token")
+		return "", false
+	}
+
+	return strings.TrimSpace(string(raw)), true
+}
+
 func waitFor(ch <-chan struct{}) {
 	<-ch
 }
 
 type unknownRepo struct {
-	Owner string `json:"owner"`
-	Name  string `json:"name"`
+	Owner  string `json:"owner"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	remote string
+	forge  forge
+}
+
+func newUnknownRepo(f forge, owner, name string) unknownRepo {
+	return unknownRepo{owner, name, f.webURL(owner, name), f.cloneURL(owner, name), f}
 }
@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/hashicorp/go-version"
+	log "github.com/sirupsen/logrus"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const frameworkModName = "icingaweb2"
+
+var modInfoLine = regexp.MustCompile(`\A(\s*)([\w ]+?)\s*:\s*(.*?)\s*\z`)
+var modInfoDep = regexp.MustCompile(`\A([^\s(]+)\s*(?:\(\s*(.*?)\s*\))?\z`)
+var frameworkVersionConst = regexp.MustCompile(`const\s+VERSION\s*=\s*'v?([^']+)'`)
+
+type moduleInfo struct {
+	name    string
+	version *version.Version
+
+	// requires maps names of required modules to the versions they have to be of (if any).
+	requires map[string]version.Constraints
+}
+
+func parseModuleInfo(raw []byte) *moduleInfo {
+	info := &moduleInfo{requires: map[string]version.Constraints{}}
+	inRequires := false
+
+	for scanner := bufio.NewScanner(bytes.NewReader(raw)); scanner.Scan(); {
+		match := modInfoLine.FindStringSubmatch(scanner.Text())
+		if match == nil {
+			continue
+		}
+
+		if match[1] == "" {
+			inRequires = false
+
+			switch strings.ToLower(match[2]) {
+			case "module":
+				info.name = match[3]
+			case "version":
+				if ver, errNV := version.NewVersion(strings.TrimPrefix(match[3], "v")); errNV == nil {
+					info.version = ver
+				}
+			case "depends":
+				info.addRequires(match[3])
+			case "requires":
+				inRequires = true
+			}
+		} else if inRequires && strings.ToLower(match[2]) == "modules" {
+			info.addRequires(match[3])
+		}
+	}
+
+	return info
+}
+
+func (mi *moduleInfo) addRequires(list string) {
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+
+		match := modInfoDep.FindStringSubmatch(item)
+		if match == nil {
+			log.WithFields(log.Fields{"bad_requirement": item}).Warn("Something is wrong with a module requirement")
+			continue
+		}
+
+		var constraints version.Constraints
+		if match[2] != "" {
+			var errNC error
+			if constraints, errNC = version.NewConstraint(match[2]); errNC != nil {
+				log.WithFields(log.Fields{
+					"bad_requirement": item, "error": jsonableError{errNC},
+				}).Warn("Something is wrong with a module requirement")
+				continue
+			}
+		}
+
+		mi.requires[match[1]] = constraints
+	}
+}
+
+// readGitFile reads file at commit from the mirror of remote. It reports a missing file as nil content.
+func readGitFile(remote, commit, file string) (content []byte, ok bool) {
+	local := path.Join(gitMirrorPath, mirrorDir(remote))
+
+	ls, ok := runCmd("git", "-C", local, "ls-tree", "--name-only", commit, file)
+	if !ok {
+		return nil, false
+	}
+
+	if len(bytes.TrimSpace(ls)) < 1 {
+		return nil, true
+	}
+
+	return runCmd("git", "-C", local, "show", commit+":"+file)
+}
+
+// frameworkVersion tells the Icinga Web 2 version at the selected commit of framework.
+func frameworkVersion(framework *gitRepo) *version.Version {
+	if php, ok := readGitFile(framework.remote, framework.commit, "library/Icinga/Application/Version.php"); ok {
+		if match := frameworkVersionConst.FindSubmatch(php); match != nil {
+			if ver, errNV := version.NewVersion(string(match[1])); errNV == nil {
+				return ver
+			}
+		}
+	}
+
+	return framework.tagVersion()
+}
+
+func (gr *gitRepo) tagVersion() *version.Version {
+	if match := versionTag.FindStringSubmatch(gr.ref); match != nil {
+		if ver, errNV := version.NewVersion(match[1]); errNV == nil {
+			return ver
+		}
+	}
+
+	return nil
+}
+
+// compatChecker chooses module versions whose requirements are satisfied.
+type compatChecker struct {
+	framework        *gitRepo
+	frameworkVersion *version.Version
+	infos            map[repoCommit]*moduleInfo
+	bundled          map[string]*moduleInfo
+}
+
+func newCompatChecker(framework *gitRepo) *compatChecker {
+	return &compatChecker{
+		framework, frameworkVersion(framework), map[repoCommit]*moduleInfo{}, map[string]*moduleInfo{},
+	}
+}
+
+type repoCommit struct {
+	remote, commit string
+}
+
+// info returns the module.info of repo at its selected commit.
+func (cc *compatChecker) info(repo *gitRepo) *moduleInfo {
+	key := repoCommit{repo.remote, repo.commit}
+	if info, ok := cc.infos[key]; ok {
+		return info
+	}
+
+	info := &moduleInfo{requires: map[string]version.Constraints{}}
+	if raw, ok := readGitFile(repo.remote, repo.commit, "module.info"); ok && raw != nil {
+		info = parseModuleInfo(raw)
+	}
+
+	if info.version == nil {
+		info.version = repo.tagVersion()
+	}
+
+	cc.infos[key] = info
+	return info
+}
+
+// bundledInfo returns the module.info of a module shipped with the framework, if any.
+func (cc *compatChecker) bundledInfo(name string) *moduleInfo {
+	if info, ok := cc.bundled[name]; ok {
+		return info
+	}
+
+	var info *moduleInfo
+	if raw, ok := readGitFile(
+		cc.framework.remote, cc.framework.commit, path.Join("modules", name, "module.info"),
+	); ok && raw != nil {
+		info = parseModuleInfo(raw)
+	}
+
+	cc.bundled[name] = info
+	return info
+}
+
+// selectCompatible falls back to older tags of modules until all requirements are satisfied.
+// Modules without any satisfying tag are skipped with the reason returned.
+func (cc *compatChecker) selectCompatible(mods map[string]gitRepo) (selected map[string]gitRepo, skipped map[string]string) {
+	selected = make(map[string]gitRepo, len(mods))
+	for name, repo := range mods {
+		selected[name] = repo
+	}
+
+	skipped = map[string]string{}
+	names := sortedModNames(mods)
+
+	for changed := true; changed; {
+		changed = false
+
+		for _, name := range names {
+			repo, ok := selected[name]
+			if !ok {
+				continue
+			}
+
+			reason := cc.unsatisfied(name, &repo, selected)
+			if reason == "" {
+				continue
+			}
+
+			changed = true
+
+			if len(repo.older) < 1 {
+				log.WithFields(log.Fields{"module": name, "reason": reason}).Warn("Skipping incompatible module")
+
+				delete(selected, name)
+				skipped[name] = reason
+				break
+			}
+
+			log.WithFields(log.Fields{
+				"module": name, "ref": repo.ref, "reason": reason, "fallback": repo.older[0],
+			}).Info("Module incompatible, trying older tag")
+
+			commit, ok := runCmd(
+				"git", "-C", path.Join(gitMirrorPath, mirrorDir(repo.remote)), "log", "-1", "--format=%H", repo.older[0],
+			)
+			if !ok {
+				delete(selected, name)
+				skipped[name] = fmt.Sprintf("couldn't resolve tag %s", repo.older[0])
+				break
+			}
+
+			repo.gitRef = gitRef{repo.older[0], string(bytes.TrimSpace(commit))}
+			repo.older = repo.older[1:]
+			selected[name] = repo
+			break
+		}
+	}
+
+	return
+}
+
+// unsatisfied tells which requirement of module name at its selected commit isn't satisfied, if any.
+func (cc *compatChecker) unsatisfied(name string, repo *gitRepo, selected map[string]gitRepo) string {
+	info := cc.info(repo)
+	for _, req := range sortedRequirements(info) {
+		constraints := info.requires[req]
+		if constraints == nil {
+			continue
+		}
+
+		var have *version.Version
+		if req == frameworkModName {
+			have = cc.frameworkVersion
+		} else if dep, ok := selected[req]; ok {
+			have = cc.info(&dep).version
+		} else if info := cc.bundledInfo(req); info != nil {
+			have = info.version
+		}
+
+		if have == nil {
+			log.WithFields(log.Fields{
+				"module": name, "requires": req, "constraint": constraints.String(),
+			}).Debug("Can't check module requirement")
+			continue
+		}
+
+		if !constraints.Check(have.Core()) {
+			return fmt.Sprintf("requires %s %s, but got %s", req, constraints.String(), have.String())
+		}
+	}
+
+	return ""
+}
+
+// modProblem is something which prevented a module or its dependencies from being installed.
+type modProblem struct {
+	Module  string `json:"module"`
+	Problem string `json:"problem"`
+}
+
+// resolveDeps adds the modules the selected ones require from the repositories not covered by any pattern.
+// It reports required modules it couldn't find.
+func (cc *compatChecker) resolveDeps(
+	matched, selected map[string]gitRepo, unknown map[unknownRepo]struct{}, updated map[string]gitRepo,
+) (added bool, missing []modProblem) {
+	orderedUnknown := make([]unknownRepo, 0, len(unknown))
+	for repo := range unknown {
+		orderedUnknown = append(orderedUnknown, repo)
+	}
+
+	sort.Slice(orderedUnknown, func(i, j int) bool {
+		return orderedUnknown[i].URL < orderedUnknown[j].URL
+	})
+
+	for _, name := range sortedModNames(selected) {
+		repo := selected[name]
+
+		for _, req := range sortedRequirements(cc.info(&repo)) {
+			if req == frameworkModName || cc.bundledInfo(req) != nil {
+				continue
+			}
+
+			if _, ok := matched[req]; ok {
+				if _, ok := selected[req]; !ok {
+					missing = append(missing, modProblem{name, fmt.Sprintf("requires %s which has been skipped", req)})
+				}
+
+				continue
+			}
+
+			if dep, ok := cc.findModule(req, orderedUnknown, updated); ok {
+				log.WithFields(log.Fields{"module": req, "required_by": name, "remote": dep.remote}).Info(
+					"Adding required module",
+				)
+
+				depRepo := updated[dep.remote]
+				depRepo.requiredBy = name
+				matched[req] = depRepo
+				delete(unknown, dep)
+				added = true
+			} else {
+				log.WithFields(log.Fields{"module": name, "requires": req}).Warn("Required module not found")
+				missing = append(missing, modProblem{name, fmt.Sprintf("requires %s which hasn't been found", req)})
+			}
+		}
+	}
+
+	return
+}
+
+// findModule looks for the repository of module name, preferring the one declaring it in its module.info.
+func (cc *compatChecker) findModule(name string, candidates []unknownRepo, updated map[string]gitRepo) (unknownRepo, bool) {
+	for _, repo := range candidates {
+		if mirror, ok := updated[repo.remote]; ok && cc.info(&mirror).name == name {
+			return repo, true
+		}
+	}
+
+	for _, repo := range candidates {
+		if _, ok := updated[repo.remote]; ok {
+			if repo.Name == name || strings.HasSuffix(repo.Name, "-"+name) {
+				return repo, true
+			}
+		}
+	}
+
+	return unknownRepo{}, false
+}
+
+// findCycles reports circular requirements among the selected modules.
+func (cc *compatChecker) findCycles(selected map[string]gitRepo) (cycles []modProblem) {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := make(map[string]int, len(selected))
+	var stack []string
+	var visit func(name string)
+
+	visit = func(name string) {
+		state[name] = visiting
+		stack = append(stack, name)
+		repo := selected[name]
+
+		for _, req := range sortedRequirements(cc.info(&repo)) {
+			if _, ok := selected[req]; !ok {
+				continue
+			}
+
+			switch state[req] {
+			case unvisited:
+				visit(req)
+			case visiting:
+				for i, member := range stack {
+					if member == req {
+						cycle := strings.Join(append(append([]string(nil), stack[i:]...), req), " -> ")
+
+						log.WithFields(log.Fields{"cycle": cycle}).Warn("Modules require each other")
+						cycles = append(cycles, modProblem{req, "circular requirement: " + cycle})
+						break
+					}
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[name] = visited
+	}
+
+	for _, name := range sortedModNames(selected) {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+
+	return
+}
+
+func sortedModNames(mods map[string]gitRepo) []string {
+	names := make([]string, 0, len(mods))
+	for name := range mods {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func sortedRequirements(info *moduleInfo) []string {
+	reqs := make([]string, 0, len(info.requires))
+	for req := range info.requires {
+		reqs = append(reqs, req)
+	}
+
+	sort.Strings(reqs)
+	return reqs
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"mime"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// matrixTxn makes the transaction IDs of Matrix messages unique.
+var matrixTxn uint64
+
+// notifier delivers notifications via one channel.
+type notifier interface {
+	// send delivers a notification and tells whether that worked. It logs failures.
+	send(subject, body string) bool
+}
+
+// newNotifiers returns a notifier per channel configured in config.
+// It also tells whether it could set up all of them, i.e. whether their secrets were readable.
+func newNotifiers(config *notifyConfig) (notifiers []notifier, ok bool) {
+	ok = true
+
+	if config.SNail != "" {
+		notifiers = append(notifiers, sNail{config.SNail})
+	}
+
+	if sc := &config.SMTP; sc.Server != "" {
+		if password, ok := readToken(sc.Password, sc.PasswordFile); ok {
+			var auth smtp.Auth
+			if sc.Username != "" {
+				host, _, _ := net.SplitHostPort(sc.Server)
+				auth = smtp.PlainAuth("", sc.Username, password, host)
+			}
+
+			notifiers = append(notifiers, smtpMail{sc.Server, auth, sc.From, sc.To})
+		} else {
+			ok = false
+		}
+	}
+
+	for _, uri := range config.Webhooks {
+		notifiers = append(notifiers, jsonWebhook{uri})
+	}
+
+	for _, chat := range config.Slack {
+		notifiers = append(notifiers, slackWebhook{chat.URL, chat.Channel})
+	}
+
+	if mc := &config.Matrix; mc.Homeserver != "" {
+		if token, ok := readToken(mc.Token, mc.TokenFile); ok {
+			for _, room := range mc.Rooms {
+				notifiers = append(notifiers, matrixRoom{strings.TrimSuffix(mc.Homeserver, "/"), "Bearer " + token, room})
+			}
+		} else {
+			ok = false
+		}
+	}
+
+	return
+}
+
+// sNail sends e-mails via the s-nail command.
+type sNail struct {
+	address string
+}
+
+var _ notifier = sNail{}
+
+func (sn sNail) send(subject, body string) bool {
+	log.WithFields(log.Fields{"email": sn.address}).Info("Notifying via s-nail")
+
+	var out bytes.Buffer
+	cmd := exec.Command("s-nail", "-s", subject, sn.address)
+
+	cmd.Stdin = strings.NewReader(body)
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+
+	if errRn := cmd.Run(); errRn != nil {
+		log.WithFields(log.Fields{
+			"email": sn.address, "error": jsonableError{errRn}, "output": jsonableStringer{&out},
+		}).Error("Couldn't notify via s-nail")
+		return false
+	}
+
+	return true
+}
+
+// smtpMail sends e-mails via an SMTP server.
+type smtpMail struct {
+	server string
+	auth   smtp.Auth
+	from   string
+	to     []string
+}
+
+var _ notifier = smtpMail{}
+
+func (sm smtpMail) send(subject, body string) bool {
+	log.WithFields(log.Fields{"server": sm.server, "email": sm.to}).Info("Notifying via SMTP")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", sm.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(sm.to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.Replace(body, "\n", "\r\n", -1))
+
+	if errSM := smtp.SendMail(sm.server, sm.auth, sm.from, sm.to, msg.Bytes()); errSM != nil {
+		log.WithFields(log.Fields{
+			"server": sm.server, "email": sm.to, "error": jsonableError{errSM},
+		}).Error("Couldn't notify via SMTP")
+		return false
+	}
+
+	return true
+}
+
+// jsonWebhook posts notifications as JSON objects with a subject and a body.
+type jsonWebhook struct {
+	url string
+}
+
+var _ notifier = jsonWebhook{}
+
+func (jw jsonWebhook) send(subject, body string) bool {
+	log.WithFields(log.Fields{"url": jw.url}).Info("Notifying via webhook")
+
+	return sendJSON(http.MethodPost, jw.url, "", "", map[string]string{"subject": subject, "body": body})
+}
+
+// slackWebhook posts notifications to a Slack or Mattermost incoming webhook.
+type slackWebhook struct {
+	url, channel string
+}
+
+var _ notifier = slackWebhook{}
+
+func (sw slackWebhook) send(subject, body string) bool {
+	log.WithFields(log.Fields{"url": sw.url, "channel": sw.channel}).Info("Notifying via Slack webhook")
+
+	msg := map[string]string{"text": subject + "\n\n" + body}
+	if sw.channel != "" {
+		msg["channel"] = sw.channel
+	}
+
+	return sendJSON(http.MethodPost, sw.url, "", "", msg)
+}
+
+// matrixRoom posts notifications to a Matrix room.
+type matrixRoom struct {
+	homeserver, auth, room string
+}
+
+var _ notifier = matrixRoom{}
+
+func (mr matrixRoom) send(subject, body string) bool {
+	log.WithFields(log.Fields{"homeserver": mr.homeserver, "room": mr.room}).Info("Notifying via Matrix")
+
+	txn := fmt.Sprintf("dockerweb2-%d-%d", time.Now().UnixNano(), atomic.AddUint64(&matrixTxn, 1))
+
+	return sendJSON(
+		http.MethodPut,
+		fmt.Sprintf(
+			"%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", mr.homeserver, url.PathEscape(mr.room), txn,
+		),
+		"Authorization", mr.auth,
+		map[string]string{"msgtype": "m.text", "body": subject + "\n\n" + body},
+	)
+}
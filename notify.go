@@ -2,21 +2,32 @@ package main
 
 import (
 	"bytes"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	log "github.com/sirupsen/logrus"
-	"os/exec"
+	"io/ioutil"
+	"os"
 	"path"
 	"sort"
+	"time"
 )
 
-func notify(config notifyConfig, unknown map[unknownRepo]struct{}) {
+// notify reports the repositories of profile not covered by any pattern and the module problems
+// which haven't been reported yet.
+func notify(profile string, config notifyConfig, unknown map[unknownRepo]struct{}, problems []modProblem) {
+	// unchecked are the repos not known to be modules or not. They're neither discovered nor disappeared.
+	unchecked := map[string]struct{}{}
 	{
 		noModInfo := map[unknownRepo]struct{}{}
 		for repo := range unknown {
-			lsModInfo, ok := runCmd("git", "-C", path.Join(
-				gitMirrorPath, hex.EncodeToString([]byte(fmt.Sprintf("%s/%s", repo.Owner, repo.Name))),
-			), "ls-tree", "--name-only", "HEAD", "module.info")
+			lsModInfo, ok := runCmd(
+				"git", "-C", path.Join(gitMirrorPath, mirrorDir(repo.remote)),
+				"ls-tree", "--name-only", "HEAD", "module.info",
+			)
+
+			if !ok {
+				unchecked[repo.URL] = struct{}{}
+			}
 
 			if !ok || len(lsModInfo) < 1 {
 				noModInfo[repo] = struct{}{}
@@ -28,53 +39,334 @@ func notify(config notifyConfig, unknown map[unknownRepo]struct{}) {
 		}
 	}
 
+	orderedUnknown := make([]unknownRepo, 0, len(unknown))
+
 	if len(unknown) > 0 {
-		orderedUnknown := make([]unknownRepo, 0, len(unknown))
 		for repo := range unknown {
 			orderedUnknown = append(orderedUnknown, repo)
 		}
 
 		sort.Slice(orderedUnknown, func(i, j int) bool {
-			if orderedUnknown[i].Owner == orderedUnknown[j].Owner {
-				return orderedUnknown[i].Name < orderedUnknown[j].Name
-			} else {
-				return orderedUnknown[i].Owner < orderedUnknown[j].Owner
-			}
+			return orderedUnknown[i].URL < orderedUnknown[j].URL
 		})
 
 		log.WithFields(log.Fields{
 			"repos": orderedUnknown,
 		}).Warn("The repository patterns didn't cover some repositories")
+	} else {
+		log.Trace("The repository patterns covered all repositories")
+	}
 
-		if config.SNail != "" {
-			log.WithFields(log.Fields{"email": config.SNail}).Info("Notifying via s-nail")
+	state := loadNotifyState()
+	reported := state.profile(profile)
+	now := time.Now()
 
-			cmd := exec.Command("s-nail", "-s", "dockerweb2 discovered new repos", config.SNail)
-			var in, out bytes.Buffer
+	var discovered, remaining []unknownRepo
+	{
+		known := make(map[string]struct{}, len(reported.Unknown))
+		for _, url := range reported.Unknown {
+			known[url] = struct{}{}
+		}
 
-			in.Write([]byte(`dockerweb2 scanned the repositories as configured and discovered ones which aren't covered by any configured repository pattern (per repository owner):
+		for _, repo := range orderedUnknown {
+			if _, ok := known[repo.URL]; ok {
+				remaining = append(remaining, repo)
+			} else {
+				discovered = append(discovered, repo)
+			}
+		}
+	}
 
-`))
+	var disappeared []string
+	{
+		current := make(map[string]struct{}, len(orderedUnknown))
+		for _, repo := range orderedUnknown {
+			current[repo.URL] = struct{}{}
+		}
 
-			for _, repo := range orderedUnknown {
-				fmt.Fprintf(&in, "* %s%s/%s\n", githubPrefix, repo.Owner, repo.Name)
+		for _, url := range reported.Unknown {
+			if _, ok := current[url]; !ok {
+				if _, ok := unchecked[url]; !ok {
+					disappeared = append(disappeared, url)
+				}
 			}
+		}
+	}
 
-			in.Write([]byte(`
+	var lastDigest time.Time
+	digest := false
 
-Please configure additional patterns which cover them by either including ( \Aiw2-mod-(.+)\z ) or ignoring ( \Ano-mod-() ).`))
+	if config.Digest != "" {
+		lastDigest = reported.LastDigest
+
+		if lastDigest.IsZero() {
+			lastDigest = now
+		} else if schedule, errCP := cronParser.Parse(config.Digest); errCP == nil && !schedule.Next(lastDigest).After(now) {
+			lastDigest, digest = now, true
+		}
+	}
 
-			cmd.Stdin = &in
-			cmd.Stdout = &out
-			cmd.Stderr = &out
+	if !digest {
+		remaining = nil
+	}
 
-			if errRn := cmd.Run(); errRn != nil {
-				log.WithFields(log.Fields{
-					"email": config.SNail, "error": jsonableError{errRn}, "output": jsonableStringer{&out},
-				}).Error("Couldn't notify via s-nail")
+	var newProblems []modProblem
+	{
+		known := make(map[modProblem]struct{}, len(reported.Problems))
+		for _, problem := range reported.Problems {
+			known[problem] = struct{}{}
+		}
+
+		for _, problem := range problems {
+			if _, ok := known[problem]; digest || !ok {
+				newProblems = append(newProblems, problem)
 			}
 		}
-	} else {
-		log.Trace("The repository patterns covered all repositories")
 	}
+
+	if len(discovered) > 0 || len(disappeared) > 0 || len(remaining) > 0 || len(newProblems) > 0 {
+		subject, body := describeUnknown(discovered, disappeared, remaining, newProblems)
+		if !sendNotification(&config, subject, body) {
+			// Try again next time.
+			return
+		}
+	}
+
+	stillUnknown := make([]string, 0, len(orderedUnknown))
+	for _, repo := range orderedUnknown {
+		stillUnknown = append(stillUnknown, repo.URL)
+	}
+
+	for _, url := range reported.Unknown {
+		if _, ok := unchecked[url]; ok {
+			stillUnknown = append(stillUnknown, url)
+		}
+	}
+
+	sort.Strings(stillUnknown)
+	reported.Unknown = stillUnknown
+
+	reported.Problems = append([]modProblem(nil), problems...)
+	reported.LastDigest = lastDigest
+	state.save()
+}
+
+// describeUnknown renders a notification about newly discovered, disappeared and still uncovered repositories
+// as well as module problems.
+func describeUnknown(
+	discovered []unknownRepo, disappeared []string, remaining []unknownRepo, problems []modProblem,
+) (subject string, body string) {
+	var in bytes.Buffer
+	section := func(intro string) {
+		if in.Len() > 0 {
+			in.Write([]byte("\n\n"))
+		}
+
+		in.Write([]byte(intro))
+		in.Write([]byte("\n\n"))
+	}
+
+	if len(discovered) > 0 {
+		subject = "dockerweb2 discovered new repos"
+		section("dockerweb2 scanned the repositories as configured and discovered ones " +
+			"which aren't covered by any configured repository pattern (per repository owner):")
+
+		for _, repo := range discovered {
+			fmt.Fprintf(&in, "* %s\n", repo.URL)
+		}
+	}
+
+	if len(disappeared) > 0 {
+		if subject == "" {
+			subject = "dockerweb2 noticed uncovered repos disappearing"
+		}
+
+		section("These repositories reported previously as not covered " +
+			"are covered now, gone or no modules anymore:")
+
+		for _, url := range disappeared {
+			fmt.Fprintf(&in, "* %s\n", url)
+		}
+	}
+
+	if len(remaining) > 0 {
+		if subject == "" {
+			subject = "dockerweb2 digest of uncovered repos"
+		}
+
+		section("These repositories reported previously " +
+			"are still not covered by any configured repository pattern:")
+
+		for _, repo := range remaining {
+			fmt.Fprintf(&in, "* %s\n", repo.URL)
+		}
+	}
+
+	if len(discovered) > 0 || len(remaining) > 0 {
+		in.Write([]byte(`
+
+Please configure additional patterns which cover them ( \Aiw2-mod-(.+)\z ) or ignore them via exclude, ignore, skip_archived or skip_forks.`))
+	}
+
+	if len(problems) > 0 {
+		if subject == "" {
+			subject = "dockerweb2 found module problems"
+		}
+
+		section("dockerweb2 resolved the modules' requirements and couldn't satisfy all of them:")
+
+		for _, problem := range problems {
+			fmt.Fprintf(&in, "* %s: %s\n", problem.Module, problem.Problem)
+		}
+	}
+
+	return subject, in.String()
+}
+
+// notifyState remembers across restarts which uncovered repos and module problems have been reported already
+// and what has been deployed.
+type notifyState struct {
+	Profiles map[string]*profileNotifyState `json:"profiles"`
+}
+
+type profileNotifyState struct {
+	Unknown    []string     `json:"unknown"`
+	Problems   []modProblem `json:"problems"`
+	LastDigest time.Time    `json:"last_digest"`
+	Deployed   *lockfile    `json:"deployed,omitempty"`
+}
+
+func loadNotifyState() *notifyState {
+	state := &notifyState{map[string]*profileNotifyState{}}
+
+	raw, errRF := ioutil.ReadFile(notifyStatePath)
+	if errRF != nil {
+		if !os.IsNotExist(errRF) {
+			log.WithFields(log.Fields{"path": notifyStatePath, "error": jsonableError{errRF}}).Warn(
+				"Couldn't read notification state",
+			)
+		}
+
+		return state
+	}
+
+	if errJU := json.Unmarshal(raw, state); errJU != nil {
+		log.WithFields(log.Fields{"path": notifyStatePath, "error": jsonableError{errJU}}).Warn(
+			"Couldn't parse notification state",
+		)
+		return &notifyState{map[string]*profileNotifyState{}}
+	}
+
+	if state.Profiles == nil {
+		state.Profiles = map[string]*profileNotifyState{}
+	}
+
+	return state
+}
+
+func (ns *notifyState) profile(name string) *profileNotifyState {
+	reported, ok := ns.Profiles[name]
+	if !ok {
+		reported = &profileNotifyState{}
+		ns.Profiles[name] = reported
+	}
+
+	return reported
+}
+
+func (ns *notifyState) save() {
+	raw, errJM := json.Marshal(ns)
+	if errJM != nil {
+		log.WithFields(log.Fields{"error": jsonableError{errJM}}).Error("Couldn't render notification state")
+		return
+	}
+
+	tmp := notifyStatePath + ".tmp"
+	if errWF := ioutil.WriteFile(tmp, raw, 0600); errWF != nil {
+		log.WithFields(log.Fields{"path": tmp, "error": jsonableError{errWF}}).Error(
+			"Couldn't write notification state",
+		)
+		return
+	}
+
+	rename(tmp, notifyStatePath)
+}
+
+// notifyConfigRejected tells that an invalid config.yml was rejected in favor of the previous one.
+func notifyConfigRejected(config *notifyConfig, problems []string) {
+	var in bytes.Buffer
+
+	fmt.Fprintf(&in, `dockerweb2 rejected the changed %s and keeps running with the previous one. These are the problems:
+
+`, configPath)
+
+	for _, problem := range problems {
+		fmt.Fprintf(&in, "* %s\n", problem)
+	}
+
+	sendNotification(config, "dockerweb2 rejected its new config", in.String())
+}
+
+// notifyReleases summarizes which versions the deployed build of profile (lock) changed since the previous deploy
+// and remembers lock as deployed.
+func notifyReleases(profile string, config *notifyConfig, lock *lockfile) {
+	state := loadNotifyState()
+	deployed := state.profile(profile)
+
+	if config.Releases && deployed.Deployed != nil {
+		var in bytes.Buffer
+
+		for _, change := range diffLockfiles(deployed.Deployed, lock) {
+			switch {
+			case change.old == nil:
+				fmt.Fprintf(&in, "* %s %s (new)\n", change.name, change.new.describe())
+			case change.new == nil:
+				fmt.Fprintf(&in, "* %s %s (removed)\n", change.name, change.old.describe())
+				continue
+			case change.old.Tag != change.new.Tag:
+				fmt.Fprintf(&in, "* %s: %s -> %s\n", change.name, change.old.describe(), change.new.describe())
+			default:
+				continue
+			}
+
+			if url := change.new.releaseURL(); url != "" {
+				fmt.Fprintf(&in, "  %s\n", url)
+			}
+		}
+
+		if in.Len() > 0 {
+			body := fmt.Sprintf("dockerweb2 deployed a build of the profile %s with these changes:\n\n%s", profile, &in)
+			if !sendNotification(config, "dockerweb2 deployed new releases", body) {
+				// Try again next time.
+				return
+			}
+		}
+	}
+
+	deployed.Deployed = lock
+	state.save()
+}
+
+// lastDeployed returns what has been deployed for profile last, if known.
+func lastDeployed(profile string) *lockfile {
+	return loadNotifyState().profile(profile).Deployed
+}
+
+// rememberDeployed remembers lock as deployed for profile.
+func rememberDeployed(profile string, lock *lockfile) {
+	state := loadNotifyState()
+	state.profile(profile).Deployed = lock
+	state.save()
+}
+
+// sendNotification notifies via all channels configured in config and tells whether all of them worked.
+func sendNotification(config *notifyConfig, subject, body string) bool {
+	notifiers, ok := newNotifiers(config)
+	for _, n := range notifiers {
+		if !n.send(subject, body) {
+			ok = false
+		}
+	}
+
+	return ok
 }
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/go-github/v28/github"
+	log "github.com/sirupsen/logrus"
+	"net/url"
+	"strings"
+)
+
+// pullRequester opens and updates pull (or merge) requests via a forge's API.
+type pullRequester interface {
+	// findPR looks for an open PR into base from a branch of the same repository starting with prefix.
+	findPR(base, prefix string) (id int, branch string, ok bool)
+	createPR(base, branch, title, body string) bool
+	updatePR(id int, title, body string) bool
+	closePR(id int) bool
+}
+
+func newPullRequester(config *pullRequestConfig) pullRequester {
+	token, ok := readToken(config.Token, config.TokenFile)
+	if !ok {
+		return nil
+	}
+
+	repo := newRepoOrigin(nil, config.Repo)
+	base := strings.TrimSuffix(config.URL, "/")
+
+	switch config.Forge {
+	case forgeGitHub:
+		return githubPR{newGitHubClient(token), repo.owner, repo.name}
+	case forgeGitLab:
+		return gitlabPR{fmt.Sprintf("%s/api/v4/projects/%s", base, url.PathEscape(config.Repo)), token}
+	case forgeGitea:
+		return giteaPR{
+			fmt.Sprintf("%s/api/v1/repos/%s/%s", base, url.PathEscape(repo.owner), url.PathEscape(repo.name)),
+			"token " + token,
+		}
+	}
+
+	return nil
+}
+
+// sendJSON is like requestJSON, but also treats a 404 as failure.
+func sendJSON(method, uri, authHeader, auth string, in interface{}) bool {
+	found, ok := requestJSON(method, uri, authHeader, auth, in, nil)
+	if ok && !found {
+		log.WithFields(log.Fields{"method": method, "url": uri}).Error("API endpoint not found")
+	}
+
+	return found && ok
+}
+
+type githubPR struct {
+	client      *github.Client
+	owner, name string
+}
+
+var _ pullRequester = githubPR{}
+
+func (gp githubPR) findPR(base, prefix string) (int, string, bool) {
+	opts := github.PullRequestListOptions{State: "open", Base: base, ListOptions: github.ListOptions{PerPage: 100}}
+
+	for {
+		prs, resp, errLs := gp.client.PullRequests.List(background, gp.owner, gp.name, &opts)
+		if errLs != nil {
+			log.WithFields(log.Fields{
+				"owner": gp.owner, "repo": gp.name, "error": jsonableError{errLs},
+			}).Error("Couldn't list pull requests")
+			return 0, "", false
+		}
+
+		for _, pr := range prs {
+			if !strings.EqualFold(pr.GetHead().GetRepo().GetFullName(), gp.owner+"/"+gp.name) {
+				continue
+			}
+
+			if branch := pr.GetHead().GetRef(); strings.HasPrefix(branch, prefix) {
+				return pr.GetNumber(), branch, true
+			}
+		}
+
+		if resp.NextPage == 0 {
+			return 0, "", true
+		}
+
+		opts.Page = resp.NextPage
+	}
+}
+
+func (gp githubPR) createPR(base, branch, title, body string) bool {
+	pr, _, errCr := gp.client.PullRequests.Create(background, gp.owner, gp.name, &github.NewPullRequest{
+		Title: &title, Head: &branch, Base: &base, Body: &body,
+	})
+	if errCr != nil {
+		log.WithFields(log.Fields{
+			"owner": gp.owner, "repo": gp.name, "error": jsonableError{errCr},
+		}).Error("Couldn't create pull request")
+		return false
+	}
+
+	log.WithFields(log.Fields{"url": pr.GetHTMLURL()}).Info("Created pull request")
+	return true
+}
+
+func (gp githubPR) updatePR(id int, title, body string) bool {
+	_, _, errEd := gp.client.PullRequests.Edit(background, gp.owner, gp.name, id, &github.PullRequest{
+		Title: &title, Body: &body,
+	})
+	if errEd != nil {
+		log.WithFields(log.Fields{
+			"owner": gp.owner, "repo": gp.name, "number": id, "error": jsonableError{errEd},
+		}).Error("Couldn't update pull request")
+		return false
+	}
+
+	return true
+}
+
+func (gp githubPR) closePR(id int) bool {
+	state := "closed"
+
+	_, _, errEd := gp.client.PullRequests.Edit(background, gp.owner, gp.name, id, &github.PullRequest{State: &state})
+	if errEd != nil {
+		log.WithFields(log.Fields{
+			"owner": gp.owner, "repo": gp.name, "number": id, "error": jsonableError{errEd},
+		}).Error("Couldn't close pull request")
+		return false
+	}
+
+	return true
+}
+
+type gitlabPR struct {
+	api, token string
+}
+
+var _ pullRequester = gitlabPR{}
+
+func (gp gitlabPR) findPR(base, prefix string) (int, string, bool) {
+	for page := 1; ; page++ {
+		var mrs []struct {
+			IID             int    `json:"iid"`
+			ProjectID       int    `json:"project_id"`
+			SourceProjectID int    `json:"source_project_id"`
+			SourceBranch    string `json:"source_branch"`
+		}
+
+		found, ok := getJSON(
+			fmt.Sprintf(
+				"%s/merge_requests?state=opened&target_branch=%s&per_page=100&page=%d",
+				gp.api, url.QueryEscape(base), page,
+			),
+			"PRIVATE-TOKEN", gp.token, &mrs,
+		)
+		if !ok || !found {
+			if ok {
+				log.WithFields(log.Fields{"api": gp.api}).Error("No such GitLab project")
+			}
+
+			return 0, "", false
+		}
+
+		for _, mr := range mrs {
+			if mr.SourceProjectID == mr.ProjectID && strings.HasPrefix(mr.SourceBranch, prefix) {
+				return mr.IID, mr.SourceBranch, true
+			}
+		}
+
+		if len(mrs) < 100 {
+			return 0, "", true
+		}
+	}
+}
+
+func (gp gitlabPR) createPR(base, branch, title, body string) bool {
+	return sendJSON("POST", gp.api+"/merge_requests", "PRIVATE-TOKEN", gp.token, map[string]string{
+		"source_branch": branch, "target_branch": base, "title": title, "description": body,
+	})
+}
+
+func (gp gitlabPR) updatePR(id int, title, body string) bool {
+	return sendJSON(
+		"PUT", fmt.Sprintf("%s/merge_requests/%d", gp.api, id), "PRIVATE-TOKEN", gp.token,
+		map[string]string{"title": title, "description": body},
+	)
+}
+
+func (gp gitlabPR) closePR(id int) bool {
+	return sendJSON(
+		"PUT", fmt.Sprintf("%s/merge_requests/%d", gp.api, id), "PRIVATE-TOKEN", gp.token,
+		map[string]string{"state_event": "close"},
+	)
+}
+
+type giteaPR struct {
+	api, auth string
+}
+
+var _ pullRequester = giteaPR{}
+
+func (gp giteaPR) findPR(base, prefix string) (int, string, bool) {
+	for page := 1; ; page++ {
+		var prs []struct {
+			Number int `json:"number"`
+			Head   struct {
+				Ref    string `json:"ref"`
+				RepoID int    `json:"repo_id"`
+			} `json:"head"`
+			Base struct {
+				Ref    string `json:"ref"`
+				RepoID int    `json:"repo_id"`
+			} `json:"base"`
+		}
+
+		found, ok := getJSON(
+			fmt.Sprintf("%s/pulls?state=open&limit=50&page=%d", gp.api, page), "Authorization", gp.auth, &prs,
+		)
+		if !ok || !found {
+			if ok {
+				log.WithFields(log.Fields{"api": gp.api}).Error("No such Gitea repository")
+			}
+
+			return 0, "", false
+		}
+
+		for _, pr := range prs {
+			if pr.Base.Ref == base && pr.Head.RepoID == pr.Base.RepoID && strings.HasPrefix(pr.Head.Ref, prefix) {
+				return pr.Number, pr.Head.Ref, true
+			}
+		}
+
+		if len(prs) < 50 {
+			return 0, "", true
+		}
+	}
+}
+
+func (gp giteaPR) createPR(base, branch, title, body string) bool {
+	return sendJSON("POST", gp.api+"/pulls", "Authorization", gp.auth, map[string]string{
+		"head": branch, "base": base, "title": title, "body": body,
+	})
+}
+
+func (gp giteaPR) updatePR(id int, title, body string) bool {
+	return sendJSON(
+		"PATCH", fmt.Sprintf("%s/pulls/%d", gp.api, id), "Authorization", gp.auth,
+		map[string]string{"title": title, "body": body},
+	)
+}
+
+func (gp giteaPR) closePR(id int) bool {
+	return sendJSON(
+		"PATCH", fmt.Sprintf("%s/pulls/%d", gp.api, id), "Authorization", gp.auth,
+		map[string]string{"state": "closed"},
+	)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	log "github.com/sirupsen/logrus"
+	"io/ioutil"
+	"text/template"
+)
+
+const (
+	fetchModeGit     = "git"
+	fetchModeTarball = "tarball"
+)
+
+const defaultScriptTemplate = `#!/bin/sh
+set -exo pipefail
+
+rm -rf dockerweb2-temp
+git clone --bare '{{ .Framework.Remote }}' dockerweb2-temp
+# {{ .Framework.Comment }}
+git -C dockerweb2-temp archive --prefix=icingaweb2/ {{ .Framework.Commit }} |tar -x
+{{ range .Mods }}
+if [ ! -e 'icingaweb2/modules/{{ .Name }}' ]; then
+	rm -rf dockerweb2-temp
+	git clone --bare '{{ .Remote }}' dockerweb2-temp
+	# {{ .Comment }}
+	git -C dockerweb2-temp archive '--prefix=icingaweb2/modules/{{ .Name }}/' {{ .Commit }} |tar -x
+fi
+{{ end }}
+rm -rf dockerweb2-temp
+`
+
+const tarballScriptTemplate = `#!/bin/sh
+set -exo pipefail
+
+rm -rf dockerweb2-temp
+{{- with .Framework }}
+{{- if .SHA256 }}
+mkdir dockerweb2-temp
+wget -O dockerweb2-temp/archive.tar.gz '{{ .Archive }}'
+gzip -d dockerweb2-temp/archive.tar.gz
+# {{ .Comment }}
+echo '{{ .SHA256 }}  dockerweb2-temp/archive.tar' |sha256sum -c
+tar -x -C dockerweb2-temp -f dockerweb2-temp/archive.tar
+mv 'dockerweb2-temp/{{ .ArchiveDir }}' icingaweb2
+{{- else }}
+git clone --bare '{{ .Remote }}' dockerweb2-temp
+# {{ .Comment }}
+git -C dockerweb2-temp archive --prefix=icingaweb2/ {{ .Commit }} |tar -x
+{{- end }}
+{{- end }}
+{{ range .Mods }}
+if [ ! -e 'icingaweb2/modules/{{ .Name }}' ]; then
+	rm -rf dockerweb2-temp
+{{- if .SHA256 }}
+	mkdir dockerweb2-temp
+	wget -O dockerweb2-temp/archive.tar.gz '{{ .Archive }}'
+	gzip -d dockerweb2-temp/archive.tar.gz
+	# {{ .Comment }}
+	echo '{{ .SHA256 }}  dockerweb2-temp/archive.tar' |sha256sum -c
+	tar -x -C dockerweb2-temp -f dockerweb2-temp/archive.tar
+	mv 'dockerweb2-temp/{{ .ArchiveDir }}' 'icingaweb2/modules/{{ .Name }}'
+{{- else }}
+	git clone --bare '{{ .Remote }}' dockerweb2-temp
+	# {{ .Comment }}
+	git -C dockerweb2-temp archive '--prefix=icingaweb2/modules/{{ .Name }}/' {{ .Commit }} |tar -x
+{{- end }}
+fi
+{{ end }}
+rm -rf dockerweb2-temp
+`
+
+// scriptRepo is a Git repository as seen by script templates.
+type scriptRepo struct {
+	Remote  string
+	Tag     string
+	Commit  string
+	Comment string
+
+	// Archive, ArchiveDir and SHA256 describe the forge's tarball (if any and fetch mode is tarball).
+	Archive    string
+	ArchiveDir string
+	SHA256     string
+}
+
+type scriptMod struct {
+	Name string
+	scriptRepo
+}
+
+// scriptData is what script templates get.
+type scriptData struct {
+	Framework scriptRepo
+	Mods      []scriptMod
+}
+
+func newScriptRepo(repo *gitRepo) scriptRepo {
+	return scriptRepo{
+		repo.remote, repo.ref, repo.commit, repo.describe(), repo.archiveURL, repo.archiveDir, repo.archiveSHA256,
+	}
+}
+
+// loadScriptTemplate parses the template in file or, if none given, the default one for fetchMode.
+func loadScriptTemplate(file, fetchMode string) (*template.Template, error) {
+	if file == "" {
+		if fetchMode == fetchModeTarball {
+			return template.Must(template.New(fetchModeTarball).Parse(tarballScriptTemplate)), nil
+		}
+
+		return template.Must(template.New("default").Parse(defaultScriptTemplate)), nil
+	}
+
+	log.WithFields(log.Fields{"file": file}).Debug("Loading script template")
+
+	raw, errRF := ioutil.ReadFile(file)
+	if errRF != nil {
+		return nil, errRF
+	}
+
+	return template.New(file).Option("missingkey=error").Parse(string(raw))
+}
+
+func renderScript(templateFile, fetchMode string, res *buildResult) ([]byte, bool) {
+	tpl, errLT := loadScriptTemplate(templateFile, fetchMode)
+	if errLT != nil {
+		log.WithFields(log.Fields{"file": templateFile, "error": jsonableError{errLT}}).Error(
+			"Couldn't load script template",
+		)
+		return nil, false
+	}
+
+	data := scriptData{Framework: newScriptRepo(&res.framework), Mods: make([]scriptMod, 0, len(res.mods))}
+	for _, mod := range sortedModNames(res.mods) {
+		repo := res.mods[mod]
+		data.Mods = append(data.Mods, scriptMod{mod, newScriptRepo(&repo)})
+	}
+
+	var buf bytes.Buffer
+	if errEx := tpl.Execute(&buf, data); errEx != nil {
+		log.WithFields(log.Fields{"error": jsonableError{errEx}}).Error("Couldn't render script")
+		return nil, false
+	}
+
+	return buf.Bytes(), true
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	log "github.com/sirupsen/logrus"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultWebhookDebounce = time.Minute
+
+// maxWebhookPayload is the largest payload GitHub documents to send.
+const maxWebhookPayload = 25 << 20
+
+var hooks = &webhookReceiver{
+	pending: map[string]struct{}{}, due: map[string]struct{}{}, ready: make(chan struct{}, 1),
+}
+
+// webhookReceiver queues debounced builds of the profiles tracking repositories forges report changes of.
+type webhookReceiver struct {
+	sync.Mutex
+
+	secret   []byte
+	debounce time.Duration
+	profiles []*profile
+	patterns map[string]*regexp.Regexp
+	pending  map[string]struct{}
+	timer    *time.Timer
+
+	// due are the profiles to build once the main loop gets to it. It's told so via ready.
+	due   map[string]struct{}
+	ready chan struct{}
+}
+
+// webhookEvent is a change of a repository reported by a forge.
+type webhookEvent struct {
+	forge       string
+	owner, name string
+	url         string
+	created     bool
+}
+
+// configure applies the config of a successfully validated config.yml.
+func (wr *webhookReceiver) configure(
+	config *webhookConfig, profiles []*profile, patterns map[string]*regexp.Regexp,
+) {
+	var secret []byte
+	if config.Secret != "" || config.SecretFile != "" {
+		if raw, ok := readToken(config.Secret, config.SecretFile); ok {
+			secret = []byte(raw)
+		}
+	}
+
+	debounce := defaultWebhookDebounce
+	if config.Debounce != "" {
+		debounce, _ = time.ParseDuration(config.Debounce)
+	}
+
+	wr.Lock()
+	defer wr.Unlock()
+
+	wr.secret = secret
+	wr.debounce = debounce
+	wr.profiles = profiles
+	wr.patterns = patterns
+}
+
+// parse verifies a webhook request and extracts the event. Irrelevant events are reported as nil.
+func (wr *webhookReceiver) parse(header http.Header, body []byte) (event *webhookEvent, code int) {
+	wr.Lock()
+	secret := wr.secret
+	wr.Unlock()
+
+	if secret == nil {
+		return nil, http.StatusNotFound
+	}
+
+	var kind, eventType string
+	var verified bool
+
+	switch {
+	case header.Get("X-Gitea-Event") != "":
+		kind, eventType = forgeGitea, header.Get("X-Gitea-Event")
+		verified = validHMAC(secret, body, header.Get("X-Gitea-Signature"))
+	case header.Get("X-Gitlab-Event") != "":
+		kind, eventType = forgeGitLab, header.Get("X-Gitlab-Event")
+		verified = subtle.ConstantTimeCompare(secret, []byte(header.Get("X-Gitlab-Token"))) == 1
+	case header.Get("X-GitHub-Event") != "":
+		kind, eventType = forgeGitHub, header.Get("X-GitHub-Event")
+		verified = validHMAC(secret, body, strings.TrimPrefix(header.Get("X-Hub-Signature-256"), "sha256="))
+	default:
+		return nil, http.StatusBadRequest
+	}
+
+	if !verified {
+		return nil, http.StatusUnauthorized
+	}
+
+	var payload struct {
+		Action     string `json:"action"`
+		Repository struct {
+			Name  string `json:"name"`
+			Owner struct {
+				Login    string `json:"login"`
+				Username string `json:"username"`
+			} `json:"owner"`
+			HTMLURL string `json:"html_url"`
+		} `json:"repository"`
+		EventName string `json:"event_name"`
+		Project   struct {
+			PathWithNamespace string `json:"path_with_namespace"`
+			WebURL            string `json:"web_url"`
+		} `json:"project"`
+		PathWithNamespace string `json:"path_with_namespace"`
+	}
+
+	if errUJ := json.Unmarshal(body, &payload); errUJ != nil {
+		log.WithFields(log.Fields{"forge": kind, "error": jsonableError{errUJ}}).Warn(
+			"Couldn't parse webhook payload",
+		)
+		return nil, http.StatusBadRequest
+	}
+
+	event = &webhookEvent{forge: kind}
+
+	if kind == forgeGitLab {
+		fullName := payload.Project.PathWithNamespace
+		event.url = payload.Project.WebURL
+
+		switch eventType {
+		case "Push Hook", "Tag Push Hook", "Release Hook":
+		case "System Hook":
+			switch payload.EventName {
+			case "push", "tag_push":
+			case "project_create":
+				fullName = payload.PathWithNamespace
+				event.created = true
+			default:
+				return nil, http.StatusOK
+			}
+		default:
+			return nil, http.StatusOK
+		}
+
+		if slash := strings.LastIndexByte(fullName, '/'); slash >= 0 {
+			event.owner, event.name = fullName[:slash], fullName[slash+1:]
+		}
+	} else {
+		switch eventType {
+		case "release", "create", "push":
+			if payload.Action == "deleted" {
+				return nil, http.StatusOK
+			}
+		case "repository":
+			if payload.Action != "created" {
+				return nil, http.StatusOK
+			}
+
+			event.created = true
+		default:
+			return nil, http.StatusOK
+		}
+
+		event.owner = payload.Repository.Owner.Login
+		if event.owner == "" {
+			event.owner = payload.Repository.Owner.Username
+		}
+
+		event.name = payload.Repository.Name
+		event.url = payload.Repository.HTMLURL
+	}
+
+	if event.owner == "" || event.name == "" {
+		return nil, http.StatusBadRequest
+	}
+
+	return event, http.StatusAccepted
+}
+
+func validHMAC(secret, body []byte, signature string) bool {
+	expected, errDS := hex.DecodeString(signature)
+	if errDS != nil {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// affected returns the names of the profiles tracking the repository of event
+// or, if it has been created, watching its owner.
+func (wr *webhookReceiver) affected(event *webhookEvent) (names []string) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	for _, p := range wr.profiles {
+		if wr.tracks(p, event) {
+			names = append(names, p.name)
+		}
+	}
+
+	return
+}
+
+func (wr *webhookReceiver) tracks(p *profile, event *webhookEvent) bool {
+	config := &p.config.GitHub
+
+	if !event.created && strings.EqualFold(event.owner+"/"+event.name, config.Framework) {
+		switch kind := config.FrameworkForge; kind {
+		case "", forgeGitHub:
+			if event.forge == forgeGitHub {
+				return true
+			}
+		default:
+			if event.forge == kind && strings.HasPrefix(event.url, strings.TrimSuffix(config.FrameworkURL, "/")+"/") {
+				return true
+			}
+		}
+	}
+
+	for _, mod := range config.Mods {
+		kind := mod.Forge
+		if kind == "" {
+			kind = forgeGitHub
+		}
+
+		if kind != event.forge || !strings.EqualFold(mod.User, event.owner) {
+			continue
+		}
+
+		if kind != forgeGitHub && !strings.HasPrefix(event.url, strings.TrimSuffix(mod.URL, "/")+"/") {
+			continue
+		}
+
+		if event.created {
+			return true
+		}
+
+		for _, repo := range mod.Repos {
+			if rgx := wr.patterns[repo]; rgx != nil {
+				if match := rgx.FindStringSubmatch(event.name); match != nil && strings.TrimSpace(match[1]) != "" {
+					return true
+				}
+			}
+		}
+	}
+
+	return false
+}
+
+// queue requests builds of profiles once no further events arrived for the debounce time.
+func (wr *webhookReceiver) queue(profiles []string) {
+	wr.Lock()
+	defer wr.Unlock()
+
+	for _, name := range profiles {
+		wr.pending[name] = struct{}{}
+	}
+
+	if wr.timer == nil {
+		wr.timer = time.AfterFunc(wr.debounce, wr.fire)
+	} else {
+		wr.timer.Reset(wr.debounce)
+	}
+}
+
+// fire hands the pending builds over to the main loop. Builds already due but not started yet are merged.
+func (wr *webhookReceiver) fire() {
+	wr.Lock()
+	defer wr.Unlock()
+
+	for name := range wr.pending {
+		log.WithFields(log.Fields{"profile": name}).Info("Build requested via webhook")
+		wr.due[name] = struct{}{}
+	}
+
+	wr.pending = map[string]struct{}{}
+	wr.timer = nil
+
+	select {
+	case wr.ready <- struct{}{}:
+	default:
+	}
+}
+
+// drain returns the profiles to build now.
+func (wr *webhookReceiver) drain() []string {
+	wr.Lock()
+	defer wr.Unlock()
+
+	names := make([]string, 0, len(wr.due))
+	for name := range wr.due {
+		names = append(names, name)
+	}
+
+	wr.due = map[string]struct{}{}
+	sort.Strings(names)
+
+	return names
+}
+
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, errRA := ioutil.ReadAll(io.LimitReader(r.Body, maxWebhookPayload+1))
+	if errRA != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+
+	if len(body) > maxWebhookPayload {
+		log.WithFields(log.Fields{"remote": r.RemoteAddr, "max": maxWebhookPayload}).Warn("Rejected too large webhook")
+		http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	event, code := hooks.parse(r.Header, body)
+	if event == nil {
+		if code == http.StatusOK {
+			w.WriteHeader(http.StatusNoContent)
+		} else {
+			log.WithFields(log.Fields{"remote": r.RemoteAddr, "status": code}).Warn("Rejected webhook")
+			http.Error(w, http.StatusText(code), code)
+		}
+
+		return
+	}
+
+	fields := log.Fields{"forge": event.forge, "owner": event.owner, "name": event.name, "created": event.created}
+
+	profiles := hooks.affected(event)
+	if len(profiles) < 1 {
+		log.WithFields(fields).Debug("Ignoring webhook about untracked repo")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	log.WithFields(fields).WithFields(log.Fields{"profiles": profiles}).Info("Queueing build due to webhook")
+
+	hooks.queue(profiles)
+	w.WriteHeader(http.StatusAccepted)
+}